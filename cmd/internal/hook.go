@@ -6,7 +6,7 @@ import (
 	"os/exec"
 )
 
-// RunHookCmd runs the given command/executable,
+// RunHookCmd runs the given command/executable with the given arguments,
 // sending it a serialized ocsp response on the standard input.
 //
 // Standard output and standard error are piped into the passed in writers.
@@ -14,8 +14,8 @@ import (
 // The returned error is nil if the command runs, has no problems
 // copying stdin, stdout, and stderr, and exits with a zero exit
 // status
-func RunHookCmd(hookCmd string, resp []byte, stdout, stderr io.Writer) error {
-	cmd := exec.Command(hookCmd)
+func RunHookCmd(hookCmd string, resp []byte, stdout, stderr io.Writer, args ...string) error {
+	cmd := exec.Command(hookCmd, args...)
 	cmd.Stdin = bytes.NewReader(resp)
 	cmd.Stdout = stdout
 	cmd.Stderr = stderr
@@ -17,3 +17,13 @@ func TestRunHookCmd(t *testing.T) {
 		t.Errorf("RunHookCmd: got %s on stderr, want %s", s, want)
 	}
 }
+
+func TestRunHookCmdArgs(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if err := RunHookCmd("testdata/hook_args.sh", []byte("ocsp-response"), &stdout, &stderr, "one", "two"); err != nil {
+		t.Error(err)
+	}
+	if s, want := stdout.String(), "one two\n"; s != want {
+		t.Errorf("RunHookCmd: got %s on stdout, want %s", s, want)
+	}
+}
@@ -0,0 +1,178 @@
+package internal
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tbroyer/ocspd"
+)
+
+// HTTPOptions configures how OCSP responders are queried.
+type HTTPOptions struct {
+	// CacheDir is the directory where HTTP responses are cached (created if
+	// needed); if empty, they aren't cached.
+	CacheDir string
+	// Proxy is the URL of the HTTP proxy, possibly with credentials; if
+	// empty, the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables
+	// are used.
+	Proxy string
+	// CAFile is a PEM file of trust anchors for HTTPS responders, in
+	// addition to the system ones.
+	CAFile string
+	// CertFile and KeyFile are the PEM files of the client certificate and
+	// private key presented to HTTPS responders.
+	CertFile string
+	KeyFile  string
+	// Timeout limits the time spent querying each OCSP responder, and
+	// ConnectTimeout the time spent establishing connections.
+	Timeout        time.Duration
+	ConnectTimeout time.Duration
+	UserAgent      string
+	// Header contains extra headers sent with each request.
+	Header http.Header
+}
+
+// AddFlags defines the flags of the HTTPOptions in fs.
+func (o *HTTPOptions) AddFlags(fs *flag.FlagSet) {
+	const (
+		cacheDirUsage       = "optional directory where to cache HTTP responses from OCSP responders (can be shared by ocspd and update-ocsp)"
+		proxyUsage          = "URL of the HTTP proxy, possibly with credentials (defaults to the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables)"
+		caFileUsage         = "optional PEM file of trust anchors for HTTPS OCSP responders, in addition to the system ones"
+		certFileUsage       = "optional PEM file of the client certificate for HTTPS OCSP responders"
+		keyFileUsage        = "PEM file of the private key of the client certificate"
+		timeoutUsage        = "maximum time spent querying each OCSP responder (0 for no limit)"
+		connectTimeoutUsage = "maximum time spent connecting to OCSP responders"
+		userAgentUsage      = "User-Agent sent to OCSP responders"
+		headerUsage         = "extra header sent to OCSP responders, as 'Name: value' (can be repeated)"
+	)
+	fs.StringVar(&o.CacheDir, "cache-dir", "", cacheDirUsage)
+	fs.StringVar(&o.Proxy, "proxy", "", proxyUsage)
+	fs.StringVar(&o.CAFile, "ca-file", "", caFileUsage)
+	fs.StringVar(&o.CertFile, "cert-file", "", certFileUsage)
+	fs.StringVar(&o.KeyFile, "key-file", "", keyFileUsage)
+	fs.DurationVar(&o.Timeout, "timeout", 30*time.Second, timeoutUsage)
+	fs.DurationVar(&o.ConnectTimeout, "connect-timeout", 30*time.Second, connectTimeoutUsage)
+	fs.StringVar(&o.UserAgent, "user-agent", "", userAgentUsage)
+	fs.Var((*headerFlag)(&o.Header), "header", headerUsage)
+}
+
+// headerFlag is a flag.Value accumulating 'Name: value' headers.
+type headerFlag http.Header
+
+func (h *headerFlag) String() string {
+	if h == nil {
+		return ""
+	}
+	var lines []string
+	for k, vs := range *h {
+		for _, v := range vs {
+			lines = append(lines, k+": "+v)
+		}
+	}
+	return strings.Join(lines, ", ")
+}
+
+func (h *headerFlag) Set(s string) error {
+	i := strings.IndexByte(s, ':')
+	if i <= 0 {
+		return fmt.Errorf("invalid header %q: expected 'Name: value'", s)
+	}
+	name := strings.TrimSpace(s[:i])
+	if name == "" || strings.ContainsAny(name, " \t") {
+		return fmt.Errorf("invalid header name %q", name)
+	}
+	if *h == nil {
+		*h = make(headerFlag)
+	}
+	http.Header(*h).Add(textproto.CanonicalMIMEHeaderKey(name), strings.TrimSpace(s[i+1:]))
+	return nil
+}
+
+// NewFetcher returns a Fetcher querying OCSP responders as configured; its
+// Logger, Metrics and RateLimit are left for the caller to set.
+func (o *HTTPOptions) NewFetcher() (*ocspd.Fetcher, error) {
+	transport, err := o.transport()
+	if err != nil {
+		return nil, err
+	}
+	var rt http.RoundTripper = transport
+	if o.CacheDir != "" {
+		if err := os.MkdirAll(o.CacheDir, 0755); err != nil {
+			return nil, err
+		}
+		rt = ocspd.NewDiskCache(o.CacheDir, transport)
+	}
+	header := o.Header.Clone()
+	if o.UserAgent != "" {
+		if header == nil {
+			header = make(http.Header)
+		}
+		header.Set("User-Agent", o.UserAgent)
+	}
+	return &ocspd.Fetcher{
+		Client:  &http.Client{Transport: rt},
+		Timeout: o.Timeout,
+		Header:  header,
+	}, nil
+}
+
+func (o *HTTPOptions) transport() (*http.Transport, error) {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if t.TLSClientConfig == nil {
+		t.TLSClientConfig = &tls.Config{}
+	}
+	if o.Proxy != "" {
+		u, err := url.Parse(o.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL: %w", err)
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid proxy URL %q: expected scheme://host:port", u.Redacted())
+		}
+		t.Proxy = http.ProxyURL(u)
+	}
+	if o.ConnectTimeout > 0 {
+		dialer := &net.Dialer{
+			Timeout:   o.ConnectTimeout,
+			KeepAlive: 30 * time.Second,
+		}
+		t.DialContext = dialer.DialContext
+		t.TLSHandshakeTimeout = o.ConnectTimeout
+	}
+	if o.CAFile != "" {
+		pem, err := ioutil.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", o.CAFile)
+		}
+		t.TLSClientConfig.RootCAs = pool
+	}
+	if o.CertFile != "" || o.KeyFile != "" {
+		if o.CertFile == "" || o.KeyFile == "" {
+			return nil, errors.New("both a client certificate and private key are needed")
+		}
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		t.TLSClientConfig.Certificates = []tls.Certificate{cert}
+	}
+	return t, nil
+}
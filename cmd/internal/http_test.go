@@ -0,0 +1,146 @@
+package internal
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHTTPOptionsFlags(t *testing.T) {
+	var o HTTPOptions
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	o.AddFlags(fs)
+	if err := fs.Parse([]string{"-header", "X-Foo: bar", "-header", "x-foo:baz ", "-user-agent", "ocspd-test", "-timeout", "10s"}); err != nil {
+		t.Fatal(err)
+	}
+	f, err := o.NewFetcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (http.Header{"X-Foo": {"bar", "baz"}, "User-Agent": {"ocspd-test"}}); !reflect.DeepEqual(f.Header, expected) {
+		t.Errorf("fetcher header: got %v, want %v", f.Header, expected)
+	}
+	if f.Timeout != 10*time.Second {
+		t.Errorf("fetcher timeout: got %v, want %v", f.Timeout, 10*time.Second)
+	}
+
+	for _, header := range []string{"no colon", ": value", "X Foo: bar"} {
+		if err := fs.Parse([]string{"-header", header}); err == nil {
+			t.Errorf("-header %q: expected an error", header)
+		}
+	}
+}
+
+func TestHTTPOptionsTLS(t *testing.T) {
+	var clientCN string
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientCN = r.TLS.PeerCertificates[0].Subject.CommonName
+	}))
+	ts.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	ts.StartTLS()
+	defer ts.Close()
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// without the extra trust anchor
+	f, err := (&HTTPOptions{CertFile: certFile, KeyFile: keyFile}).NewFetcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Client.Get(ts.URL); err == nil {
+		t.Error("client.Get: expected a certificate verification error")
+	}
+
+	f, err = (&HTTPOptions{CAFile: caFile, CertFile: certFile, KeyFile: keyFile}).NewFetcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := f.Client.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if clientCN != "client" {
+		t.Errorf("client certificate: got CN %q, want %q", clientCN, "client")
+	}
+
+	if _, err := (&HTTPOptions{CertFile: certFile}).NewFetcher(); err == nil {
+		t.Error("NewFetcher without key file: expected an error")
+	}
+}
+
+func TestHTTPOptionsProxy(t *testing.T) {
+	var proxied *http.Request
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r
+	}))
+	defer proxy.Close()
+
+	f, err := (&HTTPOptions{Proxy: "http://user:pass@" + proxy.Listener.Addr().String()}).NewFetcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := f.Client.Get("http://respo.nd/er/abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if proxied == nil {
+		t.Fatal("request not sent through the proxy")
+	}
+	if u := proxied.URL.String(); u != "http://respo.nd/er/abc" {
+		t.Errorf("proxied request: got URL %q, want %q", u, "http://respo.nd/er/abc")
+	}
+	// base64("user:pass")
+	if auth := proxied.Header.Get("Proxy-Authorization"); auth != "Basic dXNlcjpwYXNz" {
+		t.Errorf("proxied request: got Proxy-Authorization %q, want %q", auth, "Basic dXNlcjpwYXNz")
+	}
+
+	if _, err := (&HTTPOptions{Proxy: "proxy:3128"}).NewFetcher(); err == nil {
+		t.Error("NewFetcher with invalid proxy URL: expected an error")
+	}
+}
@@ -0,0 +1,233 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tbroyer/ocspd"
+)
+
+// latencyBuckets are the upper bounds of the request latency histograms, in
+// seconds.
+var latencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// Metrics collects ocspd metrics and exposes them in the Prometheus text
+// format.
+type Metrics struct {
+	// Snapshot returns the monitored tags, to compute gauges at scrape time.
+	Snapshot func() []ocspd.TagStatus
+
+	mu           sync.Mutex
+	requests     map[[3]string]float64 // responder, code, outcome
+	latencies    map[string]*histogram // responder
+	fetches      map[[2]string]float64 // responder, outcome
+	hookFailures map[string]float64    // hook
+
+	now func() time.Time
+}
+
+type histogram struct {
+	counts []float64 // per bucket, non-cumulative, with a last +Inf bucket
+	sum    float64
+	count  float64
+}
+
+func NewMetrics(snapshot func() []ocspd.TagStatus) *Metrics {
+	return &Metrics{
+		Snapshot:     snapshot,
+		requests:     make(map[[3]string]float64),
+		latencies:    make(map[string]*histogram),
+		fetches:      make(map[[2]string]float64),
+		hookFailures: make(map[string]float64),
+		now:          time.Now,
+	}
+}
+
+func outcomeLabel(outcome ocspd.EventType) string {
+	switch outcome {
+	case ocspd.EventUpdated:
+		return "updated"
+	case ocspd.EventNotModified:
+		return "not_modified"
+	case ocspd.EventFetchError:
+		return "error"
+	}
+	return outcome.String()
+}
+
+func (m *Metrics) ObserveRequest(responder string, statusCode int, outcome ocspd.EventType, latency time.Duration) {
+	code := ""
+	if statusCode != 0 {
+		code = strconv.Itoa(statusCode)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[[3]string{responder, code, outcomeLabel(outcome)}]++
+	h := m.latencies[responder]
+	if h == nil {
+		h = &histogram{counts: make([]float64, len(latencyBuckets)+1)}
+		m.latencies[responder] = h
+	}
+	s := latency.Seconds()
+	h.counts[sort.SearchFloat64s(latencyBuckets, s)]++
+	h.sum += s
+	h.count++
+}
+
+func (m *Metrics) ObserveFetch(responder string, outcome ocspd.EventType) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.fetches[[2]string{responder, outcomeLabel(outcome)}]++
+}
+
+// HookFailed records a failed run of the given hook.
+func (m *Metrics) HookFailed(hook string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.hookFailures[hook]++
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// WriteTo writes the metrics in the Prometheus text format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+	m.mu.Lock()
+	header(&b, "ocspd_responder_requests_total", "counter", "HTTP requests to OCSP responders, by HTTP status code (empty if none was received) and outcome.")
+	for _, k := range sortedKeys3(m.requests) {
+		sample(&b, "ocspd_responder_requests_total", m.requests[k], "responder", k[0], "code", k[1], "outcome", k[2])
+	}
+	header(&b, "ocspd_responder_request_duration_seconds", "histogram", "Latency of HTTP requests to OCSP responders.")
+	responders := make([]string, 0, len(m.latencies))
+	for responder := range m.latencies {
+		responders = append(responders, responder)
+	}
+	sort.Strings(responders)
+	for _, responder := range responders {
+		h := m.latencies[responder]
+		var cumulative float64
+		for i, c := range h.counts {
+			cumulative += c
+			le := math.Inf(1)
+			if i < len(latencyBuckets) {
+				le = latencyBuckets[i]
+			}
+			sample(&b, "ocspd_responder_request_duration_seconds_bucket", cumulative, "responder", responder, "le", formatFloat(le))
+		}
+		sample(&b, "ocspd_responder_request_duration_seconds_sum", h.sum, "responder", responder)
+		sample(&b, "ocspd_responder_request_duration_seconds_count", h.count, "responder", responder)
+	}
+	header(&b, "ocspd_fetches_total", "counter", "Fetches of OCSP responses, possibly failing over several OCSP responders, by outcome.")
+	for _, k := range sortedKeys2(m.fetches) {
+		sample(&b, "ocspd_fetches_total", m.fetches[k], "responder", k[0], "outcome", k[1])
+	}
+	header(&b, "ocspd_hook_failures_total", "counter", "Failed runs of hooks.")
+	hooks := make([]string, 0, len(m.hookFailures))
+	for hook := range m.hookFailures {
+		hooks = append(hooks, hook)
+	}
+	sort.Strings(hooks)
+	for _, hook := range hooks {
+		sample(&b, "ocspd_hook_failures_total", m.hookFailures[hook], "hook", hook)
+	}
+	m.mu.Unlock()
+
+	if m.Snapshot != nil {
+		snapshot := m.Snapshot()
+		now := m.now()
+		header(&b, "ocspd_next_update_seconds", "gauge", "Seconds until the NextUpdate of the OCSP response of each tag.")
+		byStatus := map[string]float64{"good": 0, "revoked": 0, "unknown": 0, "none": 0}
+		for _, ts := range snapshot {
+			if !ts.HasResponse {
+				byStatus["none"]++
+				continue
+			}
+			byStatus[StatusString(ts.Status)]++
+			if !ts.NextUpdate.IsZero() {
+				sample(&b, "ocspd_next_update_seconds", ts.NextUpdate.Sub(now).Seconds(), "tag", ts.Tag)
+			}
+		}
+		header(&b, "ocspd_certificates", "gauge", "Monitored certificates, by OCSP status (none if no OCSP response is available).")
+		statuses := make([]string, 0, len(byStatus))
+		for status := range byStatus {
+			statuses = append(statuses, status)
+		}
+		sort.Strings(statuses)
+		for _, status := range statuses {
+			sample(&b, "ocspd_certificates", byStatus[status], "status", status)
+		}
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func header(b *strings.Builder, name, typ, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func sample(b *strings.Builder, name string, value float64, labels ...string) {
+	b.WriteString(name)
+	if len(labels) > 0 {
+		b.WriteString("{")
+		for i := 0; i < len(labels); i += 2 {
+			if i > 0 {
+				b.WriteString(",")
+			}
+			b.WriteString(labels[i])
+			b.WriteString(`="`)
+			b.WriteString(labelEscaper.Replace(labels[i+1]))
+			b.WriteString(`"`)
+		}
+		b.WriteString("}")
+	}
+	b.WriteString(" ")
+	b.WriteString(formatFloat(value))
+	b.WriteString("\n")
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func sortedKeys2(m map[[2]string]float64) [][2]string {
+	keys := make([][2]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i][0] < keys[j][0] || (keys[i][0] == keys[j][0] && keys[i][1] < keys[j][1])
+	})
+	return keys
+}
+
+func sortedKeys3(m map[[3]string]float64) [][3]string {
+	keys := make([][3]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		for n := range keys[i] {
+			if keys[i][n] != keys[j][n] {
+				return keys[i][n] < keys[j][n]
+			}
+		}
+		return false
+	})
+	return keys
+}
@@ -0,0 +1,55 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tbroyer/ocspd"
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestMetrics(t *testing.T) {
+	now := time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)
+	m := NewMetrics(func() []ocspd.TagStatus {
+		return []ocspd.TagStatus{
+			{Tag: "a", HasResponse: true, Status: ocsp.Good, NextUpdate: now.Add(time.Hour)},
+			{Tag: "b\"", HasResponse: true, Status: ocsp.Revoked, NextUpdate: now.Add(-time.Minute)},
+			{Tag: "c"},
+		}
+	})
+	m.now = func() time.Time { return now }
+	m.ObserveRequest("ocsp.example.com", 304, ocspd.EventNotModified, 70*time.Millisecond)
+	m.ObserveRequest("ocsp.example.com", 200, ocspd.EventUpdated, 3*time.Second)
+	m.ObserveRequest("ocsp.example.com", 0, ocspd.EventFetchError, time.Minute)
+	m.ObserveFetch("ocsp.example.com", ocspd.EventNotModified)
+	m.HookFailed("hook")
+
+	var b strings.Builder
+	if _, err := m.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		`ocspd_responder_requests_total{responder="ocsp.example.com",code="",outcome="error"} 1`,
+		`ocspd_responder_requests_total{responder="ocsp.example.com",code="304",outcome="not_modified"} 1`,
+		`ocspd_responder_request_duration_seconds_bucket{responder="ocsp.example.com",le="0.05"} 0`,
+		`ocspd_responder_request_duration_seconds_bucket{responder="ocsp.example.com",le="0.1"} 1`,
+		`ocspd_responder_request_duration_seconds_bucket{responder="ocsp.example.com",le="5"} 2`,
+		`ocspd_responder_request_duration_seconds_bucket{responder="ocsp.example.com",le="+Inf"} 3`,
+		`ocspd_responder_request_duration_seconds_sum{responder="ocsp.example.com"} 63.07`,
+		`ocspd_responder_request_duration_seconds_count{responder="ocsp.example.com"} 3`,
+		`ocspd_fetches_total{responder="ocsp.example.com",outcome="not_modified"} 1`,
+		`ocspd_hook_failures_total{hook="hook"} 1`,
+		`ocspd_next_update_seconds{tag="a"} 3600`,
+		`ocspd_next_update_seconds{tag="b\""} -60`,
+		`ocspd_certificates{status="good"} 1`,
+		`ocspd_certificates{status="none"} 1`,
+		`ocspd_certificates{status="revoked"} 1`,
+		`ocspd_certificates{status="unknown"} 0`,
+		"# TYPE ocspd_responder_request_duration_seconds histogram",
+	} {
+		if !strings.Contains(b.String(), expected+"\n") {
+			t.Errorf("Metrics.WriteTo: missing %s in:\n%s", expected, b.String())
+		}
+	}
+}
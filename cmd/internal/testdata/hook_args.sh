@@ -0,0 +1,4 @@
+#!/bin/sh
+# Echoes its arguments, for tests.
+cat >/dev/null
+echo "$@"
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"io/ioutil"
-	"log"
+	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/tbroyer/ocspd"
@@ -15,58 +20,216 @@ import (
 
 var tickRound time.Duration
 var hookCmd string
+var nonce bool
+var concurrency int
+var onRevokedCmd string
+var withholdRevoked bool
+var stateFile string
+var shutdownTimeout time.Duration
+var logFormat string
+var logLevel string
+var metricsAddr string
+var certExpiryDays int
+var removeExpired bool
+var rateLimit float64
+var rateBurst int
+var startupSpread time.Duration
+var httpOptions internal.HTTPOptions
+var responderRulesFile string
+var responderRules ocspd.ResponderRules
+
+var logger *slog.Logger
 
 func init() {
 	const (
-		tickRoundUsage = "minimum interval between 'ticks'"
-		hookUsage      = "optional program to run if all goes well"
+		tickRoundUsage   = "minimum interval between 'ticks'"
+		hookUsage        = "optional program to run if all goes well"
+		nonceUsage       = "send a nonce with OCSP requests (forces POST requests)"
+		concurrencyUsage = "maximum number of OCSP responses fetched in parallel"
+		onRevokedUsage   = "optional program to run when a certificate is revoked (with the certificate file names as arguments)"
+		withholdUsage    = "don't store revoked OCSP responses nor pass them to the hook, and remove the stored ones"
+		stateUsage       = "optional file where to persist the scheduling state across restarts"
+		shutdownUsage    = "maximum time to wait for ongoing fetches and hooks on shutdown"
+		logFormatUsage   = "format of the logs: text or json"
+		logLevelUsage    = "minimum level of the logs: debug, info, warn or error"
+		metricsAddrUsage = "optional address (host:port) where to serve Prometheus metrics at /metrics"
+		certExpiryUsage  = "warn when a certificate expires within that many days (0 to disable)"
+		removeExpUsage   = "remove the OCSP responses of expired certificates"
+		rateLimitUsage   = "maximum number of requests per second to each OCSP responder host (0 for no limit)"
+		rateBurstUsage   = "maximum number of requests in a row to each OCSP responder host when rate limited"
+		spreadUsage      = "window over which initial fetches are spread when cached OCSP responses are still valid"
+		rulesUsage       = "optional JSON file of rules rewriting or replacing OCSP responder URLs"
 	)
 	flag.DurationVar(&tickRound, "tick", ocspd.DefaultTickRound, tickRoundUsage)
 	flag.DurationVar(&tickRound, "t", ocspd.DefaultTickRound, tickRoundUsage+" (shorthand)")
 
 	flag.StringVar(&hookCmd, "hook", "", hookUsage)
 	flag.StringVar(&hookCmd, "h", "", hookUsage+" (shorthand)")
+
+	flag.BoolVar(&nonce, "nonce", false, nonceUsage)
+
+	flag.IntVar(&concurrency, "concurrency", ocspd.DefaultConcurrency, concurrencyUsage)
+
+	flag.StringVar(&onRevokedCmd, "on-revoked", "", onRevokedUsage)
+	flag.BoolVar(&withholdRevoked, "withhold-revoked", false, withholdUsage)
+
+	flag.StringVar(&stateFile, "state", "", stateUsage)
+
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, shutdownUsage)
+
+	flag.StringVar(&logFormat, "log-format", "text", logFormatUsage)
+	flag.StringVar(&logLevel, "log-level", "info", logLevelUsage)
+
+	flag.StringVar(&metricsAddr, "metrics-addr", "", metricsAddrUsage)
+
+	flag.IntVar(&certExpiryDays, "cert-expiry-days", 0, certExpiryUsage)
+	flag.BoolVar(&removeExpired, "remove-expired", false, removeExpUsage)
+
+	flag.Float64Var(&rateLimit, "rate-limit", 0, rateLimitUsage)
+	flag.IntVar(&rateBurst, "rate-burst", 1, rateBurstUsage)
+	flag.DurationVar(&startupSpread, "startup-spread", 0, spreadUsage)
+
+	httpOptions.AddFlags(flag.CommandLine)
+
+	flag.StringVar(&responderRulesFile, "responder-rules", "", rulesUsage)
 }
 
 func main() {
 	flag.Parse()
 
+	var err error
+	logger, err = internal.NewLogger(os.Stderr, logFormat, logLevel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flag.Usage()
+		os.Exit(2)
+	}
+
 	names, err := internal.FileNames(flag.Args())
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
+	}
+
+	fetcher, err := httpOptions.NewFetcher()
+	if err != nil {
+		fatal(err)
+	}
+	if responderRulesFile != "" {
+		if responderRules, err = ocspd.LoadResponderRules(responderRulesFile); err != nil {
+			fatal(err)
+		}
 	}
 
+	metrics := internal.NewMetrics(nil)
+	fetcher.Logger = logger
+	fetcher.Metrics = metrics
+	fetcher.RateLimit = ocspd.RateLimit{Rate: rateLimit, Burst: rateBurst}
 	updater := &ocspd.Updater{
-		TickRound: tickRound,
-		Log:       log.Printf,
+		TickRound:         tickRound,
+		Concurrency:       concurrency,
+		WithholdRevoked:   withholdRevoked,
+		StateFile:         stateFile,
+		CertExpiryWarning: time.Duration(certExpiryDays) * 24 * time.Hour,
+		StartupSpread:     startupSpread,
+
+		Logger:  logger,
+		Metrics: metrics,
+		Fetcher: fetcher,
 
-		OnUpdate: func(ev ocspd.Event) {
+		// failed updates are retried by the updater
+		DeliverUpdate: func(ev ocspd.Event) error {
 			tags := strings.Join(ev.Tags, ", ")
 			internal.PrintOCSPResponse(tags, ev.Response)
 			for _, f := range ev.Tags {
 				ocspFilename := f + ".ocsp"
-				if err := ioutil.WriteFile(ocspFilename, ev.RawResponse, 0644); err != nil {
-					log.Println(f, ": ", err)
-					break
+				if err := ocspd.WriteFileAtomic(ocspFilename, ev.RawResponse, 0644); err != nil {
+					logger.Error("error while writing OCSP response", ocspd.LogKeyTags, []string{f}, "file", ocspFilename, ocspd.LogKeyError, err)
+					return err
 				}
 				// "store" ThisUpdate as file's mtime as a hint for next daemon restart
 				_ = os.Chtimes(ocspFilename, ev.Response.ThisUpdate, ev.Response.ThisUpdate)
 			}
 			if hookCmd != "" {
 				if err := internal.RunHookCmd(hookCmd, ev.RawResponse, os.Stdout, os.Stderr); err != nil {
-					log.Println(tags, ": ", err)
+					logger.Error("hook failed", ocspd.LogKeyTags, ev.Tags, "hook", hookCmd, ocspd.LogKeyError, err)
+					metrics.HookFailed("hook")
+					return err
+				}
+			}
+			return nil
+		},
+
+		OnEvent: func(ev ocspd.Event) {
+			if ev.Type != ocspd.EventCertExpired || !removeExpired {
+				return
+			}
+			// don't leave a stale OCSP response around
+			for _, f := range ev.Tags {
+				if err := os.Remove(f + ".ocsp"); err != nil && !os.IsNotExist(err) {
+					logger.Error("error while removing OCSP response", ocspd.LogKeyTags, []string{f}, "file", f+".ocsp", ocspd.LogKeyError, err)
+				}
+			}
+		},
+
+		OnRevoked: func(ev ocspd.Event) {
+			tags := strings.Join(ev.Tags, ", ")
+			if withholdRevoked {
+				internal.PrintOCSPResponse(tags, ev.Response)
+				// stop stapling: don't leave a stale (good) OCSP response around
+				for _, f := range ev.Tags {
+					if err := os.Remove(f + ".ocsp"); err != nil && !os.IsNotExist(err) {
+						logger.Error("error while removing OCSP response", ocspd.LogKeyTags, []string{f}, "file", f+".ocsp", ocspd.LogKeyError, err)
+					}
+				}
+			}
+			if onRevokedCmd != "" {
+				if err := internal.RunHookCmd(onRevokedCmd, ev.RawResponse, os.Stdout, os.Stderr, ev.Tags...); err != nil {
+					logger.Error("on-revoked hook failed", ocspd.LogKeyTags, ev.Tags, "hook", onRevokedCmd, ocspd.LogKeyError, err)
+					metrics.HookFailed("on-revoked")
 				}
 			}
 		},
 	}
 
+	if err := updater.LoadState(); err != nil && !os.IsNotExist(err) {
+		logger.Error("error while loading state", "file", stateFile, ocspd.LogKeyError, err)
+	}
 	for _, file := range names {
 		if err := addOrUpdate(file, updater); err != nil {
-			log.Fatal(err)
+			fatal(err, ocspd.LogKeyTags, []string{file})
 		}
 	}
 
-	updater.Start()
+	metrics.Snapshot = updater.Snapshot
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics)
+		server := &http.Server{Addr: metricsAddr, Handler: mux}
+		go func() {
+			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				fatal(err, "addr", metricsAddr)
+			}
+		}()
+		defer server.Close()
+	}
+	done := make(chan struct{})
+	go func() {
+		updater.Run(context.Background())
+		close(done)
+	}()
+	<-ctx.Done()
+	stop()
+
+	logger.Info("shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := updater.Shutdown(ctx); err != nil {
+		logger.Error("shutdown cut short", ocspd.LogKeyError, err)
+	}
+	<-done
 }
 
 func addOrUpdate(file string, updater *ocspd.Updater) error {
@@ -76,7 +239,7 @@ func addOrUpdate(file string, updater *ocspd.Updater) error {
 	if err != nil {
 		return err
 	}
-	req, err := ocspd.CreateRequest(cert, issuer, "")
+	req, err := ocspd.CreateRequestWithOptions(cert, issuer, &ocspd.RequestOptions{Nonce: nonce, ResponderRules: responderRules})
 	if err != nil {
 		return err
 	}
@@ -97,3 +260,8 @@ func addOrUpdate(file string, updater *ocspd.Updater) error {
 
 	return updater.AddOrUpdate(file, req, resp)
 }
+
+func fatal(err error, args ...any) {
+	logger.Error(err.Error(), args...)
+	os.Exit(1)
+}
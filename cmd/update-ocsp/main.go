@@ -5,37 +5,79 @@
 // directory (with the exception of those ending in .ocsp, .issuer, or .sctl
 // –for HAProxy compatibility–, or .key –for compatibility with almost anything
 // else, storing private keys separately–) are treated as input files.
+//
+// It exits with status 3 if at least one certificate is revoked.
 package main
 
 import (
 	"flag"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"os"
 	"time"
 
 	"github.com/tbroyer/ocspd"
 	"github.com/tbroyer/ocspd/cmd/internal"
+	"golang.org/x/crypto/ocsp"
 )
 
 var interval time.Duration
 var hookCmd string
+var nonce bool
+var onRevokedCmd string
+var withholdRevoked bool
+var logFormat string
+var logLevel string
+var rateLimit float64
+var rateBurst int
+var httpOptions internal.HTTPOptions
+var responderRulesFile string
 
 func init() {
 	const (
 		defaultInterval = 24 * time.Hour
 		intervalUsage   = "indicative interval between invocations of this tool"
 		hookUsage       = "optional program to run if all goes well"
+		nonceUsage      = "send a nonce with OCSP requests (forces POST requests)"
+		onRevokedUsage  = "optional program to run when a certificate is revoked (with the certificate file name as argument)"
+		withholdUsage   = "don't store revoked OCSP responses nor pass them to the hook, and remove the stored ones"
+		logFormatUsage  = "format of the logs: text or json"
+		logLevelUsage   = "minimum level of the logs: debug, info, warn or error"
+		rateLimitUsage  = "maximum number of requests per second to each OCSP responder host (0 for no limit)"
+		rateBurstUsage  = "maximum number of requests in a row to each OCSP responder host when rate limited"
+		rulesUsage      = "optional JSON file of rules rewriting or replacing OCSP responder URLs"
 	)
 	flag.DurationVar(&interval, "interval", defaultInterval, intervalUsage)
 	flag.DurationVar(&interval, "i", defaultInterval, intervalUsage+" (shorthand)")
 
 	flag.StringVar(&hookCmd, "hook", "", hookUsage)
 	flag.StringVar(&hookCmd, "h", "", hookUsage+" (shorthand)")
+
+	flag.BoolVar(&nonce, "nonce", false, nonceUsage)
+
+	flag.StringVar(&onRevokedCmd, "on-revoked", "", onRevokedUsage)
+	flag.BoolVar(&withholdRevoked, "withhold-revoked", false, withholdUsage)
+
+	flag.StringVar(&logFormat, "log-format", "text", logFormatUsage)
+	flag.StringVar(&logLevel, "log-level", "info", logLevelUsage)
+
+	flag.Float64Var(&rateLimit, "rate-limit", 0, rateLimitUsage)
+	flag.IntVar(&rateBurst, "rate-burst", 1, rateBurstUsage)
+
+	httpOptions.AddFlags(flag.CommandLine)
+
+	flag.StringVar(&responderRulesFile, "responder-rules", "", rulesUsage)
 }
 
+// exitRevoked is the exit code when at least one certificate is revoked,
+// whether other errors occurred or not.
+const exitRevoked = 3
+
 var exitCode = 0
+var revoked = false
+
+var logger *slog.Logger
 
 func main() {
 	flag.Parse()
@@ -45,70 +87,129 @@ func main() {
 		os.Exit(2)
 	}
 
+	var err error
+	logger, err = internal.NewLogger(os.Stderr, logFormat, logLevel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flag.Usage()
+		os.Exit(2)
+	}
+	fetcher, err := httpOptions.NewFetcher()
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+	fetcher.Logger = logger
+	fetcher.RateLimit = ocspd.RateLimit{Rate: rateLimit, Burst: rateBurst}
+
+	var rules ocspd.ResponderRules
+	if responderRulesFile != "" {
+		if rules, err = ocspd.LoadResponderRules(responderRulesFile); err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+	}
+
 	names, err := internal.FileNames(flag.Args())
 	if err != nil {
-		log.Fatal(err)
+		logger.Error(err.Error())
+		os.Exit(1)
 	}
 
 	for _, certBundleFileName := range names {
+		tags := []string{certBundleFileName}
 		cert, issuer, err := internal.ParsePEMCertificateBundle(certBundleFileName)
 		if err != nil {
-			log.Print(certBundleFileName, ": ", err)
+			logger.Error("error while parsing certificate", ocspd.LogKeyTags, tags, ocspd.LogKeyError, err)
 			exitCode = 1
 			continue
 		}
-		req, err := ocspd.CreateRequest(cert, issuer, "")
+		req, err := ocspd.CreateRequestWithOptions(cert, issuer, &ocspd.RequestOptions{Nonce: nonce, ResponderRules: rules})
 		if err != nil {
-			log.Println(certBundleFileName, ": ", err)
+			logger.Error("error while creating OCSP request", ocspd.LogKeyTags, tags, ocspd.LogKeyError, err)
 			exitCode = 1
 			continue
 		}
 		// check existing/cached OCSP response before querying the responder
 		ocspFileName := certBundleFileName + ".ocsp"
 		needsRefresh, resp, err := ocspd.NeedsRefreshFile(ocspFileName, issuer, interval)
+		if os.IsNotExist(err) {
+			// never fetched, or removed by --withhold-revoked: fetch it
+			needsRefresh, resp, err = true, nil, nil
+		}
 		if err != nil {
-			log.Println(certBundleFileName, ": ", err)
+			logger.Error("error while reading cached OCSP response", ocspd.LogKeyTags, tags, "file", ocspFileName, ocspd.LogKeyError, err)
 			exitCode = 1
 			continue
 		}
 		if !needsRefresh {
 			// cached response is "fresh" enough, don't refresh it
+			if resp.OCSPResponse.Status == ocsp.Revoked {
+				revoked = true
+			}
 			continue
 		}
 
-		resp, err = ocspd.FetchR(req, resp)
+		resp, err = fetcher.FetchR(req, resp)
 		if err != nil {
-			log.Println(certBundleFileName, ": ", err)
+			attrs := []any{ocspd.LogKeyTags, tags, ocspd.LogKeyError, err}
+			if se, ok := err.(ocspd.HTTPStatusError); ok {
+				attrs = append(attrs, ocspd.LogKeyHTTPStatus, se.StatusCode)
+			}
+			logger.Error("error while fetching OCSP response", attrs...)
 			exitCode = 1
 			continue
 		}
 		if resp == nil {
+			logger.Info("fetched OCSP response: up-to-date", ocspd.LogKeyTags, tags)
 			// conditional GET returned 304 Not Modified, update mtime for next check
 			now := time.Now()
 			os.Chtimes(ocspFileName, now, now)
 			continue
 		}
+		logger.Info("fetched OCSP response", ocspd.LogKeyTags, tags, ocspd.LogKeyStatus, statusString(resp.OCSPResponse.Status))
 		internal.PrintOCSPResponse(certBundleFileName, resp.OCSPResponse)
+		if resp.OCSPResponse.Status == ocsp.Revoked {
+			revoked = true
+			logger.Error("certificate revoked", ocspd.LogKeyTags, tags, ocspd.LogKeyStatus, statusString(resp.OCSPResponse.Status))
+			if onRevokedCmd != "" {
+				if err = internal.RunHookCmd(onRevokedCmd, resp.RawOCSPResponse, os.Stdout, os.Stderr, certBundleFileName); err != nil {
+					logger.Error("on-revoked hook failed", ocspd.LogKeyTags, tags, "hook", onRevokedCmd, ocspd.LogKeyError, err)
+					exitCode = 1
+				}
+			}
+			if withholdRevoked {
+				// stop stapling: don't leave a stale (good) OCSP response around
+				if err = os.Remove(ocspFileName); err != nil && !os.IsNotExist(err) {
+					logger.Error("error while removing OCSP response", ocspd.LogKeyTags, tags, "file", ocspFileName, ocspd.LogKeyError, err)
+					exitCode = 1
+				}
+				continue
+			}
+		}
 		if err = ioutil.WriteFile(ocspFileName, resp.RawOCSPResponse, 0644); err != nil {
-			log.Print(certBundleFileName, ": ", err)
+			logger.Error("error while writing OCSP response", ocspd.LogKeyTags, tags, "file", ocspFileName, ocspd.LogKeyError, err)
 			exitCode = 1
 			continue
 		}
 		if hookCmd != "" {
 			if err = internal.RunHookCmd(hookCmd, resp.RawOCSPResponse, os.Stdout, os.Stderr); err != nil {
-				log.Println(certBundleFileName, ": ", err)
+				logger.Error("hook failed", ocspd.LogKeyTags, tags, "hook", hookCmd, ocspd.LogKeyError, err)
 				exitCode = 1
 				continue
 			}
 		}
 	}
+	if revoked {
+		os.Exit(exitRevoked)
+	}
 	os.Exit(exitCode)
 }
 
 func statusString(status int) string {
 	s := internal.StatusString(status)
 	if s == "" {
-		log.Panicf("Unknown status %v", status)
+		panic(fmt.Sprintf("Unknown status %v", status))
 	}
 	return s
 }
@@ -116,7 +217,7 @@ func statusString(status int) string {
 func revocationReasonString(revocationReason int) string {
 	r := internal.RevocationReasonString(revocationReason)
 	if r == "" {
-		log.Panicf("Unknown revocation reason %v", revocationReason)
+		panic(fmt.Sprintf("Unknown revocation reason %v", revocationReason))
 	}
 	return r
 }
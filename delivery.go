@@ -0,0 +1,140 @@
+package ocspd
+
+import "time"
+
+const DefaultDeliveryBackoffInitial = 10 * time.Second
+
+// delivery is the state of the delivery of updates for an ocspStatus.
+type delivery struct {
+	// pending is the latest undelivered event, if any
+	pending *Event
+	// running is true while a goroutine delivers the pending events
+	running bool
+	// withheld is true when the latest event has been withheld, so older
+	// ones must not be delivered anymore
+	withheld bool
+	failures int
+	retry    *time.Timer
+}
+
+// updateFunc returns the function updates are delivered to, if any.
+func (u *Updater) updateFunc() func(Event) error {
+	if u.DeliverUpdate != nil {
+		return u.DeliverUpdate
+	}
+	if u.OnUpdate != nil {
+		return func(event Event) error {
+			u.OnUpdate(event)
+			return nil
+		}
+	}
+	return nil
+}
+
+// deliver queues the event for delivery, replacing any undelivered one for
+// the same status.
+func (u *Updater) deliver(s *ocspStatus, event Event) {
+	d := s.delivery
+	if d == nil {
+		d = &delivery{}
+		s.delivery = d
+	}
+	d.pending = &event
+	d.withheld = false
+	d.failures = 0
+	if d.retry != nil {
+		d.retry.Stop()
+		d.retry = nil
+	}
+	if !d.running {
+		u.startDelivery(s, d)
+	}
+}
+
+// withhold drops the undelivered event for the status, if any, as it's
+// superseded by a newer one that won't be delivered (e.g. a revoked OCSP
+// response, with WithholdRevoked).
+func (u *Updater) withhold(s *ocspStatus) {
+	d := s.delivery
+	if d == nil {
+		return
+	}
+	u.stopDelivery(s)
+	d.pending = nil
+	d.withheld = true
+	d.failures = 0
+}
+
+// startDelivery delivers the pending events of the status in a new goroutine,
+// one at a time, until there's none left or one fails.
+func (u *Updater) startDelivery(s *ocspStatus, d *delivery) {
+	d.running = true
+	u.callbacks++
+	go func() {
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		defer func() {
+			d.running = false
+			u.callbacks--
+			u.checkIdle()
+		}()
+		for d.pending != nil && u.isMonitored(s) {
+			event := *d.pending
+			d.pending = nil
+			// always pass the latest tags
+			event.Tags = append([]string(nil), s.Tags...)
+			f := u.updateFunc()
+			u.mu.Unlock()
+			err := f(event)
+			u.mu.Lock()
+			if err == nil {
+				d.failures = 0
+				continue
+			}
+			if d.pending != nil || d.withheld {
+				// superseded by a newer event
+				continue
+			}
+			d.pending = &event
+			d.failures++
+			delay := u.DeliveryBackoff.delay(d.failures, DefaultDeliveryBackoffInitial, u.randFunc())
+			u.logger().Warn("error while delivering OCSP response update, retrying", LogKeyTags, event.Tags, LogKeyFailures, d.failures, "delay", delay, errorAttr(err))
+			if u.shutDown {
+				return
+			}
+			d.retry = time.AfterFunc(delay, func() {
+				u.mu.Lock()
+				defer u.mu.Unlock()
+				d.retry = nil
+				if !d.running && d.pending != nil && !u.shutDown {
+					u.startDelivery(s, d)
+				}
+			})
+			return
+		}
+	}()
+}
+
+// stopDelivery stops retrying the delivery of the pending event of the
+// status, if any, returning whether there was one that won't be delivered.
+func (u *Updater) stopDelivery(s *ocspStatus) bool {
+	d := s.delivery
+	if d == nil {
+		return false
+	}
+	if d.retry != nil {
+		d.retry.Stop()
+		d.retry = nil
+	}
+	return d.pending != nil && !d.running
+}
+
+// stopDeliveries stops retrying failed deliveries, logging the ones that are
+// abandoned.
+func (u *Updater) stopDeliveries() {
+	for _, s := range u.statuses {
+		if u.stopDelivery(s) {
+			u.logger().Warn("abandoning delivery of OCSP response update", LogKeyTags, s.Tags)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package ocspd
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestUpdaterDeliveryOrder(t *testing.T) {
+	calls := make(chan *ocsp.Response, 10)
+	release := make(chan struct{})
+	u := &Updater{
+		DeliverUpdate: func(ev Event) error {
+			calls <- ev.Response
+			<-release
+			return nil
+		},
+	}
+	req := &Request{
+		endpoints: []endpoint{{url: "http://respo.nd/er/abc"}},
+		notAfter:  time.Now().Add(24 * time.Hour),
+	}
+	if err := u.AddOrUpdate("tag", req, nil); err != nil {
+		t.Fatal(err)
+	}
+	s := u.tagToStatus["tag"]
+	r1, r2, r3 := &ocsp.Response{}, &ocsp.Response{}, &ocsp.Response{}
+
+	u.mu.Lock()
+	u.emit(s, Event{Type: EventUpdated, Response: r1})
+	u.mu.Unlock()
+	if r := <-calls; r != r1 {
+		t.Fatalf("updater.DeliverUpdate: got %p, want first response %p", r, r1)
+	}
+	// while the first delivery is ongoing
+	u.mu.Lock()
+	u.emit(s, Event{Type: EventUpdated, Response: r2})
+	u.emit(s, Event{Type: EventUpdated, Response: r3})
+	u.mu.Unlock()
+	select {
+	case <-calls:
+		t.Fatal("updater.DeliverUpdate: called concurrently")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	if r := <-calls; r != r3 {
+		t.Errorf("updater.DeliverUpdate: got %p, want latest response %p", r, r3)
+	}
+	select {
+	case r := <-calls:
+		t.Errorf("updater.DeliverUpdate: unexpectedly called with %p", r)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestUpdaterDeliveryRetry(t *testing.T) {
+	calls := make(chan Event, 10)
+	var n int
+	u := &Updater{
+		DeliveryBackoff: Backoff{Initial: time.Millisecond},
+		DeliverUpdate: func(ev Event) error {
+			calls <- ev
+			if n++; n < 3 {
+				return errors.New("hook failed")
+			}
+			return nil
+		},
+	}
+	req := &Request{
+		endpoints: []endpoint{{url: "http://respo.nd/er/abc"}},
+		notAfter:  time.Now().Add(24 * time.Hour),
+	}
+	if err := u.AddOrUpdate("tag", req, nil); err != nil {
+		t.Fatal(err)
+	}
+	s := u.tagToStatus["tag"]
+	r := &ocsp.Response{}
+
+	u.mu.Lock()
+	u.emit(s, Event{Type: EventUpdated, Response: r})
+	u.mu.Unlock()
+	for i := 0; i < 3; i++ {
+		select {
+		case ev := <-calls:
+			if ev.Response != r || len(ev.Tags) != 1 || ev.Tags[0] != "tag" {
+				t.Errorf("updater.DeliverUpdate #%d: got %+v", i, ev)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("updater.DeliverUpdate: got %d calls, want 3", i)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := u.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if d := s.delivery; d.pending != nil || d.failures != 0 || d.retry != nil {
+		t.Errorf("updater.DeliverUpdate: got delivery state %+v after success", d)
+	}
+}
+
+func TestUpdaterDeliveryWithheld(t *testing.T) {
+	calls := make(chan *ocsp.Response, 10)
+	results := make(chan error, 1)
+	u := &Updater{
+		WithholdRevoked: true,
+		DeliveryBackoff: Backoff{Initial: time.Hour},
+		DeliverUpdate: func(ev Event) error {
+			calls <- ev.Response
+			return <-results
+		},
+	}
+	req := &Request{
+		endpoints: []endpoint{{url: "http://respo.nd/er/abc"}},
+		notAfter:  time.Now().Add(24 * time.Hour),
+	}
+	if err := u.AddOrUpdate("tag", req, nil); err != nil {
+		t.Fatal(err)
+	}
+	s := u.tagToStatus["tag"]
+	good, revoked := &ocsp.Response{Status: ocsp.Good}, &ocsp.Response{Status: ocsp.Revoked}
+
+	// a failed delivery waiting to be retried is abandoned
+	results <- errors.New("hook failed")
+	u.mu.Lock()
+	u.emit(s, Event{Type: EventUpdated, Response: good})
+	u.mu.Unlock()
+	<-calls
+	deadline := time.Now().Add(time.Second)
+	for {
+		u.mu.Lock()
+		retrying := s.delivery.retry != nil
+		u.mu.Unlock()
+		if retrying {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("updater.DeliverUpdate: failed delivery not retried")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	u.mu.Lock()
+	u.emit(s, Event{Type: EventUpdated, Response: revoked})
+	if d := s.delivery; d.pending != nil || d.retry != nil {
+		t.Errorf("updater.emit: got pending %v and retry %v after a withheld update, want none", d.pending, d.retry)
+	}
+	u.mu.Unlock()
+
+	// and so is an ongoing one, if it fails
+	u.mu.Lock()
+	u.emit(s, Event{Type: EventUpdated, Response: good})
+	u.mu.Unlock()
+	<-calls
+	u.mu.Lock()
+	u.emit(s, Event{Type: EventUpdated, Response: revoked})
+	u.mu.Unlock()
+	results <- errors.New("hook failed")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := u.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if d := s.delivery; d.pending != nil || d.retry != nil {
+		t.Errorf("updater.DeliverUpdate: got pending %v and retry %v after a withheld update, want none", d.pending, d.retry)
+	}
+	select {
+	case r := <-calls:
+		t.Errorf("updater.DeliverUpdate: unexpectedly called with %v", r)
+	default:
+	}
+}
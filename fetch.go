@@ -2,100 +2,228 @@ package ocspd
 
 import (
 	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"math"
+	"log/slog"
+	"math/big"
 	"mime"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 	"unicode"
 
 	"golang.org/x/crypto/ocsp"
 )
 
+// ErrCertExpired is returned when fetching the OCSP response of an expired
+// certificate (or a certificate whose issuer is expired).
+var ErrCertExpired = errors.New("ocspd: certificate is expired")
+
 var (
-	errCertExpired   = errors.New("ocspd: certificate is expired")
-	errNoContentType = errors.New("ocspd: no response content-type")
+	errNoContentType  = errors.New("ocspd: no response content-type")
+	errBadNonceLength = errors.New("ocspd: nonce length must be between 1 and 32 octets")
+	errNoResponderURL = errors.New("Cannot find an OCSP URL")
 )
 
-type errBadHTTPStatus int
+// HTTPStatusError is returned when an OCSP responder replies with an
+// unexpected HTTP status.
+type HTTPStatusError struct {
+	StatusCode int
+	// RetryAfter is the time from the Retry-After header of a 429 or 503
+	// response, or zero if absent or invalid.
+	RetryAfter time.Time
+}
 
-func (e errBadHTTPStatus) Error() string {
-	return fmt.Sprintf("ocspd: bad http status: %d", e)
+func (e HTTPStatusError) Error() string {
+	if !e.RetryAfter.IsZero() {
+		return fmt.Sprintf("ocspd: bad http status: %d (retry after %v)", e.StatusCode, e.RetryAfter)
+	}
+	return fmt.Sprintf("ocspd: bad http status: %d", e.StatusCode)
 }
 
 type errBadContentType string
 
 func (e errBadContentType) Error() string {
-	return fmt.Sprintf("ocspd: bad response content-type: %s", e)
+	return fmt.Sprintf("ocspd: bad response content-type: %s", string(e))
 }
 
-type Request struct {
+// errResponseMismatch is returned when the OCSP response is not for the
+// requested certificate (or doesn't echo the request nonce); its value is
+// the mismatching field.
+type errResponseMismatch string
+
+func (e errResponseMismatch) Error() string {
+	return fmt.Sprintf("ocspd: response does not match request: %s", string(e))
+}
+
+// DefaultNonceLength is the length of the nonce sent when RequestOptions.Nonce
+// is set without a NonceLength, as recommended by RFC 8954.
+const DefaultNonceLength = 32
+
+// id-pkix-ocsp-nonce, see RFC 8954
+var idPKIXOCSPNonce = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 2}
+
+// An endpoint is an OCSP responder URL, along with the request body to POST
+// to it if any.
+type endpoint struct {
 	url  string
 	body []byte // if nil, method will be GET, otherwise method will be POST
+	// The OCSP responder URL, without the request appended for GET
+	responderURL string
+}
+
+type Request struct {
+	// The OCSP responders to query, in order of preference
+	endpoints []endpoint
+	// The index in endpoints of the last OCSP responder that worked (accessed atomically)
+	preferred int32
 
 	// The expiration time of the certificate (or the issuer if earlier)
 	notAfter time.Time
 	issuer   *x509.Certificate
+
+	// The CertID of the request (serial number and issuer hashes), checked
+	// against the response; if nil, the response is not checked.
+	certID *ocsp.Request
+
+	// If non-zero, a nonce of that length is added to the body of each request
+	// and checked against the response.
+	nonceLength int
+}
+
+// RequestOptions contains options for CreateRequestWithOptions.
+type RequestOptions struct {
+	// ResponderURL overrides the OCSP responder URLs extracted from the
+	// certificates if non-empty.
+	ResponderURL string
+	// ResponderRules rewrite or replace the OCSP responder URLs extracted
+	// from the certificates; they're ignored if ResponderURL is non-empty.
+	ResponderRules ResponderRules
+
+	// Nonce enables sending a nonce (RFC 8954) with each request, and checking
+	// that the responder echoes it back. Requests with a nonce always use POST,
+	// as they're never cacheable.
+	Nonce bool
+	// NonceLength is the length of the nonce, between 1 and 32 octets.
+	// If zero, DefaultNonceLength is used.
+	NonceLength int
 }
 
+// CreateRequest prepares an OCSP request for the given certificate.
+//
+// If responderURL is empty then the OCSP responder URLs are extracted from
+// the certificate (or the issuer if the certificate has none); the returned
+// request will fail over from one to the next.
 func CreateRequest(cert, issuer *x509.Certificate, responderURL string) (req *Request, err error) {
-	if responderURL == "" {
-		responderURL, err = ResponderURL(cert)
+	return CreateRequestWithOptions(cert, issuer, &RequestOptions{ResponderURL: responderURL})
+}
+
+// CreateRequestWithOptions is like CreateRequest but allows more control over
+// the request; opts can be nil.
+func CreateRequestWithOptions(cert, issuer *x509.Certificate, opts *RequestOptions) (req *Request, err error) {
+	if opts == nil {
+		opts = &RequestOptions{}
+	}
+	var nonceLength int
+	if opts.Nonce {
+		nonceLength = opts.NonceLength
+		if nonceLength == 0 {
+			nonceLength = DefaultNonceLength
+		}
+		if nonceLength < 1 || nonceLength > 32 {
+			return nil, errBadNonceLength
+		}
+	}
+
+	var responderURLs []string
+	if opts.ResponderURL != "" {
+		responderURLs = []string{opts.ResponderURL}
+	} else {
+		responderURLs, err = ResponderURLs(cert)
 		if err != nil {
 			return nil, err
 		}
-		if responderURL == "" {
-			responderURL, err = ResponderURL(issuer)
+		if len(responderURLs) == 0 {
+			responderURLs, err = ResponderURLs(issuer)
 			if err != nil {
 				return nil, err
 			}
 		}
+		if err = opts.ResponderRules.Validate(); err != nil {
+			return nil, err
+		}
+		if responderURLs, err = opts.ResponderRules.Apply(responderURLs, issuer); err != nil {
+			return nil, err
+		}
+		if len(responderURLs) == 0 {
+			return nil, errNoResponderURL
+		}
 	}
 
 	r, err := ocsp.CreateRequest(cert, issuer, nil)
 	if err != nil {
 		return nil, err
 	}
+	certID, err := ocsp.ParseRequest(r)
+	if err != nil {
+		return nil, err
+	}
 
 	notAfter := cert.NotAfter
 	if issuer.NotAfter.Before(notAfter) {
 		notAfter = issuer.NotAfter
 	}
 
-	getURL := responderURL
-	if !strings.HasSuffix(getURL, "/") {
-		getURL += "/"
+	req = &Request{
+		notAfter:    notAfter,
+		issuer:      issuer,
+		certID:      certID,
+		nonceLength: nonceLength,
 	}
-	getURL += strings.Replace(url.QueryEscape(base64.StdEncoding.EncodeToString(r)), "+", "%20", -1)
-	if len(getURL) <= 255 {
-		req = &Request{
-			url:      getURL,
-			notAfter: notAfter,
-			issuer:   issuer,
+	for _, responderURL := range responderURLs {
+		getURL := responderURL
+		if !strings.HasSuffix(getURL, "/") {
+			getURL += "/"
 		}
-	} else {
-		req = &Request{
-			url:      responderURL,
-			body:     r,
-			notAfter: notAfter,
-			issuer:   issuer,
+		getURL += strings.Replace(url.QueryEscape(base64.StdEncoding.EncodeToString(r)), "+", "%20", -1)
+		if len(getURL) <= 255 && nonceLength == 0 {
+			req.endpoints = append(req.endpoints, endpoint{url: getURL, responderURL: responderURL})
+		} else {
+			req.endpoints = append(req.endpoints, endpoint{url: responderURL, body: r, responderURL: responderURL})
 		}
 	}
 	return req, nil
 }
 
-func (r *Request) createHTTPRequest(etag string, lastModified time.Time) (req *http.Request, err error) {
-	if r.body == nil {
-		if req, err = http.NewRequest("GET", r.url, nil); err != nil {
-			return nil, err
+func (r *Request) preferredEndpoint() int {
+	return int(atomic.LoadInt32(&r.preferred))
+}
+
+func (r *Request) setPreferredEndpoint(i int) {
+	atomic.StoreInt32(&r.preferred, int32(i))
+}
+
+// createHTTPRequest creates the HTTP request to send to the OCSP responder
+// at the given endpoint.
+//
+// The returned nonce is the one added to the OCSP request, if any.
+func (r *Request) createHTTPRequest(ctx context.Context, e *endpoint, etag string, lastModified time.Time) (req *http.Request, nonce []byte, err error) {
+	if e.body == nil {
+		if req, err = http.NewRequestWithContext(ctx, "GET", e.url, nil); err != nil {
+			return nil, nil, err
 		}
 		switch {
 		case etag != "":
@@ -104,29 +232,238 @@ func (r *Request) createHTTPRequest(etag string, lastModified time.Time) (req *h
 			req.Header.Set("If-Modified-Since", lastModified.Format(http.TimeFormat))
 		}
 	} else {
-		if req, err = http.NewRequest("POST", r.url, bytes.NewReader(r.body)); err != nil {
-			return nil, err
+		// POST requests aren't cached, so conditional requests make no sense
+		body := e.body
+		if r.nonceLength > 0 {
+			nonce = make([]byte, r.nonceLength)
+			if _, err = rand.Read(nonce); err != nil {
+				return nil, nil, err
+			}
+			if body, err = addNonce(body, nonce); err != nil {
+				return nil, nil, err
+			}
+		}
+		if req, err = http.NewRequestWithContext(ctx, "POST", e.url, bytes.NewReader(body)); err != nil {
+			return nil, nil, err
 		}
 		req.Header.Set("Content-Type", "application/ocsp-request")
 	}
-	return req, nil
+	return req, nonce, nil
+}
+
+func (r *Request) parseResponse(resp *http.Response, nonce []byte, now time.Time) (*Response, error) {
+	res, err := parseResponse(resp, r.issuer, now)
+	if err != nil || res.OCSPResponse == nil {
+		return res, err
+	}
+	if err = r.checkResponse(res.OCSPResponse, nonce); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// checkResponse checks that the OCSP response is for the requested certificate,
+// and that it echoes the nonce if one was sent.
+func (r *Request) checkResponse(resp *ocsp.Response, nonce []byte) error {
+	if r.certID == nil && nonce == nil {
+		return nil
+	}
+	data, err := parseResponseData(resp.TBSResponseData)
+	if err != nil {
+		return err
+	}
+	if r.certID != nil {
+		if err = r.checkCertID(resp, &data.Responses[0].CertID); err != nil {
+			return err
+		}
+	}
+	if nonce != nil {
+		return checkNonce(data, nonce)
+	}
+	return nil
+}
+
+func (r *Request) checkCertID(resp *ocsp.Response, id *certID) (err error) {
+	if resp.SerialNumber == nil || resp.SerialNumber.Cmp(r.certID.SerialNumber) != 0 {
+		return errResponseMismatch("serial number")
+	}
+	nameHash, keyHash := r.certID.IssuerNameHash, r.certID.IssuerKeyHash
+	if resp.IssuerHash != r.certID.HashAlgorithm {
+		// the responder used another hash algorithm than the one in the request
+		if r.issuer == nil {
+			return errResponseMismatch("hash algorithm")
+		}
+		if nameHash, keyHash, err = issuerHashes(r.issuer, resp.IssuerHash); err != nil {
+			return err
+		}
+	}
+	if !bytes.Equal(id.NameHash, nameHash) {
+		return errResponseMismatch("issuer name hash")
+	}
+	if !bytes.Equal(id.IssuerKeyHash, keyHash) {
+		return errResponseMismatch("issuer key hash")
+	}
+	return nil
+}
+
+// checkNonce checks that the response echoes the request nonce.
+//
+// The nonce is expected in the responseExtensions, but some responders put it
+// in the singleExtensions instead. Per RFC 8954, the extension value is the
+// DER encoding of an OCTET STRING, but some older responders put the raw nonce
+// directly; both are accepted.
+func checkNonce(data *responseData, nonce []byte) error {
+	want, err := asn1.Marshal(nonce)
+	if err != nil {
+		return err
+	}
+	for _, exts := range [][]pkix.Extension{data.ResponseExtensions, data.Responses[0].SingleExtensions} {
+		for _, ext := range exts {
+			if !ext.Id.Equal(idPKIXOCSPNonce) {
+				continue
+			}
+			if bytes.Equal(ext.Value, want) || bytes.Equal(ext.Value, nonce) {
+				return nil
+			}
+			return errResponseMismatch("nonce")
+		}
+	}
+	return errResponseMismatch("missing nonce")
+}
+
+// The following types mirror the ones from golang.org/x/crypto/ocsp,
+// which doesn't expose the CertID and extensions of the response, and
+// doesn't allow adding extensions to the request.
+
+type tbsRequest struct {
+	Version           int              `asn1:"explicit,tag:0,default:0,optional"`
+	RequestorName     pkix.RDNSequence `asn1:"explicit,tag:1,optional"`
+	RequestList       []asn1.RawValue
+	RequestExtensions []pkix.Extension `asn1:"explicit,tag:2,optional"`
+}
+
+type ocspRequest struct {
+	TBSRequest tbsRequest
+}
+
+type certID struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	NameHash      []byte
+	IssuerKeyHash []byte
+	SerialNumber  *big.Int
+}
+
+type singleResponse struct {
+	CertID           certID
+	Good             asn1.Flag        `asn1:"tag:0,optional"`
+	Revoked          revokedInfo      `asn1:"tag:1,optional"`
+	Unknown          asn1.Flag        `asn1:"tag:2,optional"`
+	ThisUpdate       time.Time        `asn1:"generalized"`
+	NextUpdate       time.Time        `asn1:"generalized,explicit,tag:0,optional"`
+	SingleExtensions []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+type revokedInfo struct {
+	RevocationTime time.Time       `asn1:"generalized"`
+	Reason         asn1.Enumerated `asn1:"explicit,tag:0,optional"`
+}
+
+type responseData struct {
+	Version            int `asn1:"optional,default:0,explicit,tag:0"`
+	RawResponderID     asn1.RawValue
+	ProducedAt         time.Time `asn1:"generalized"`
+	Responses          []singleResponse
+	ResponseExtensions []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+func parseResponseData(tbsResponseData []byte) (*responseData, error) {
+	var data responseData
+	rest, err := asn1.Unmarshal(tbsResponseData, &data)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, ocsp.ParseError("trailing data in OCSP response data")
+	}
+	if len(data.Responses) != 1 {
+		return nil, ocsp.ParseError("OCSP response contains bad number of responses")
+	}
+	return &data, nil
+}
+
+// addNonce adds a nonce extension to the DER-encoded OCSP request.
+func addNonce(der, nonce []byte) ([]byte, error) {
+	var req ocspRequest
+	if _, err := asn1.Unmarshal(der, &req); err != nil {
+		return nil, err
+	}
+	value, err := asn1.Marshal(nonce)
+	if err != nil {
+		return nil, err
+	}
+	req.TBSRequest.RequestExtensions = append(req.TBSRequest.RequestExtensions, pkix.Extension{
+		Id:    idPKIXOCSPNonce,
+		Value: value,
+	})
+	return asn1.Marshal(req)
+}
+
+// issuerHashes computes the issuer name and key hashes the same way as ocsp.CreateRequest.
+func issuerHashes(issuer *x509.Certificate, hash crypto.Hash) (nameHash, keyHash []byte, err error) {
+	if !hash.Available() {
+		return nil, nil, x509.ErrUnsupportedAlgorithm
+	}
+	var publicKeyInfo struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(issuer.RawSubjectPublicKeyInfo, &publicKeyInfo); err != nil {
+		return nil, nil, err
+	}
+	h := hash.New()
+	h.Write(issuer.RawSubject)
+	nameHash = h.Sum(nil)
+	h.Reset()
+	h.Write(publicKeyInfo.PublicKey.RightAlign())
+	keyHash = h.Sum(nil)
+	return nameHash, keyHash, nil
 }
 
 type Response struct {
 	OCSPResponse    *ocsp.Response
 	RawOCSPResponse []byte
 	MaxAge          time.Time
-	Etag            string
-	LastModified    time.Time
+	// StaleWhileRevalidate is until when the response can still be used after
+	// MaxAge while it's being refreshed (from the stale-while-revalidate
+	// Cache-Control directive), or zero if not allowed.
+	StaleWhileRevalidate time.Time
+	// StaleIfError is until when the response can still be used after MaxAge
+	// when refreshing it fails (from the stale-if-error Cache-Control
+	// directive), or zero if not allowed.
+	StaleIfError time.Time
+	Etag         string
+	LastModified time.Time
 }
 
-// A nil response with a nil error indicates a 304 Not Modified response.
+// A response with a nil OCSPResponse indicates a 304 Not Modified response;
+// it only carries the freshness and validators from its headers.
 func parseResponse(resp *http.Response, issuer *x509.Certificate, now time.Time) (*Response, error) {
 	if resp.StatusCode == http.StatusNotModified {
-		return nil, nil
+		f := parseFreshness(resp.Header, now)
+		return &Response{
+			MaxAge:               f.maxAge,
+			StaleWhileRevalidate: f.staleWhileRevalidate,
+			StaleIfError:         f.staleIfError,
+			Etag:                 resp.Header.Get("ETag"),
+			LastModified:         lastModified(resp.Header),
+		}, nil
 	}
 	if resp.StatusCode != http.StatusOK {
-		return nil, errBadHTTPStatus(resp.StatusCode)
+		err := HTTPStatusError{StatusCode: resp.StatusCode}
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+			err.RetryAfter = retryAfter(resp.Header, now)
+		}
+		return nil, err
 	}
 	ct := resp.Header.Get("Content-Type")
 	if ct == "" {
@@ -147,49 +484,119 @@ func parseResponse(resp *http.Response, issuer *x509.Certificate, now time.Time)
 	if err != nil {
 		return nil, err
 	}
+	f := parseFreshness(resp.Header, now)
 	r := &Response{
-		OCSPResponse:    or,
-		RawOCSPResponse: bytes,
-		MaxAge:          maxAge(resp.Header, now),
-		Etag:            resp.Header.Get("ETag"),
-		LastModified:    lastModified(resp.Header),
+		OCSPResponse:         or,
+		RawOCSPResponse:      bytes,
+		MaxAge:               f.maxAge,
+		StaleWhileRevalidate: f.staleWhileRevalidate,
+		StaleIfError:         f.staleIfError,
+		Etag:                 resp.Header.Get("ETag"),
+		LastModified:         lastModified(resp.Header),
 	}
 	return r, nil
 }
 
 func maxAge(h http.Header, now time.Time) time.Time {
-	if cc, ok := h["Cache-Control"]; ok {
-		now = serverDate(h, now)
-		m := math.MaxInt64
-		for _, c := range cc {
-			for rest := c; rest != ""; {
-				var k, v string
-				k, v, rest = consumeCacheControlDirective(rest)
-				switch k {
-				case "max-age":
-					if n, err := strconv.Atoi(v); n >= 0 && err == nil {
-						if n == 0 {
-							return now
-						}
-						if n < m {
-							m = n
-						}
-					}
-				case "no-cache":
-					return now
-				}
+	return parseFreshness(h, now).maxAge
+}
+
+// freshness is how long an HTTP response can be used, as told by its caching
+// headers (RFC 9111 and RFC 5861.)
+type freshness struct {
+	// maxAge is when the response becomes stale, or zero if unknown.
+	maxAge time.Time
+	// staleWhileRevalidate and staleIfError are until when the response can
+	// still be used once stale, while it's being revalidated and when
+	// revalidation fails respectively, or zero if not allowed.
+	staleWhileRevalidate time.Time
+	staleIfError         time.Time
+	// noStore is true if the response must not be stored by caches.
+	noStore bool
+}
+
+// parseFreshness computes the freshness of a response from its Cache-Control,
+// Expires, Date, and Age headers. As OCSP responses are shared by many TLS
+// clients, it behaves as a shared cache: s-maxage takes precedence over
+// max-age.
+func parseFreshness(h http.Header, now time.Time) freshness {
+	var f freshness
+	date := serverDate(h, now)
+	// account for the time the response spent in caches (e.g. a CDN)
+	generated := date
+	if age, err := strconv.Atoi(strings.TrimSpace(h.Get("Age"))); err == nil && age > 0 {
+		if g := now.Add(-time.Duration(age) * time.Second); g.Before(generated) {
+			generated = g
+		}
+	}
+	maxAge, sMaxAge, swr, sie := -1, -1, -1, -1
+	var noCache, mustRevalidate bool
+	for _, c := range h["Cache-Control"] {
+		for rest := c; rest != ""; {
+			var k, v string
+			k, v, rest = consumeCacheControlDirective(rest)
+			switch k {
+			case "max-age":
+				maxAge = minDeltaSeconds(maxAge, v)
+			case "s-maxage":
+				sMaxAge = minDeltaSeconds(sMaxAge, v)
+				// implies proxy-revalidate
+				mustRevalidate = true
+			case "stale-while-revalidate":
+				swr = minDeltaSeconds(swr, v)
+			case "stale-if-error":
+				sie = minDeltaSeconds(sie, v)
+			case "no-cache":
+				noCache = true
+			case "no-store":
+				f.noStore = true
+			case "must-revalidate", "proxy-revalidate":
+				mustRevalidate = true
 			}
 		}
-		if m != math.MaxInt64 {
-			return now.Add(time.Duration(m) * time.Second)
+	}
+	if sMaxAge >= 0 {
+		maxAge = sMaxAge
+	}
+	switch {
+	case noCache:
+		f.maxAge = date
+		return f
+	case maxAge >= 0:
+		f.maxAge = generated.Add(time.Duration(maxAge) * time.Second)
+	default:
+		eh := h.Get("Expires")
+		if eh == "" {
+			return f
+		}
+		e, err := http.ParseTime(eh)
+		if err != nil {
+			return f
 		}
+		f.maxAge = e.Add(generated.Sub(date))
 	}
-	if eh := h.Get("Expires"); eh != "" {
-		if e, err := http.ParseTime(eh); err == nil {
-			return e
+	if !mustRevalidate {
+		if swr >= 0 {
+			f.staleWhileRevalidate = f.maxAge.Add(time.Duration(swr) * time.Second)
+		}
+		if sie >= 0 {
+			f.staleIfError = f.maxAge.Add(time.Duration(sie) * time.Second)
 		}
 	}
-	return time.Time{}
+	return f
+}
+
+// minDeltaSeconds returns the minimum of m and the delta-seconds value v,
+// ignoring v if invalid; m is negative if unset.
+func minDeltaSeconds(m int, v string) int {
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return m
+	}
+	if m < 0 || n < m {
+		return n
+	}
+	return m
 }
 
 // serverDate parses the Date header or returns now
@@ -219,7 +626,7 @@ func consumeCacheControlDirective(h string) (k, v, rest string) {
 func consumeCacheControlKey(h string) (string, string) {
 	i := strings.IndexAny(h, `,=`)
 	if i == -1 {
-		return strings.TrimFunc(h, unicode.IsSpace), ""
+		return strings.ToLower(strings.TrimFunc(h, unicode.IsSpace)), ""
 	}
 	return strings.ToLower(strings.TrimFunc(h[:i], unicode.IsSpace)), h[i:]
 }
@@ -248,6 +655,20 @@ func consumeCacheControlValue(h string) (string, string) {
 	return h, ""
 }
 
+// retryAfter parses the Retry-After header, either as delta-seconds or
+// an HTTP-date.
+func retryAfter(h http.Header, now time.Time) time.Time {
+	raStr := h.Get("Retry-After")
+	if raStr == "" {
+		return time.Time{}
+	}
+	if secs, err := strconv.ParseUint(raStr, 10, 31); err == nil {
+		return now.Add(time.Duration(secs) * time.Second)
+	}
+	ra, _ := http.ParseTime(raStr)
+	return ra
+}
+
 func lastModified(h http.Header) time.Time {
 	lmStr := h.Get("Last-Modified")
 	if lmStr == "" {
@@ -259,6 +680,27 @@ func lastModified(h http.Header) time.Time {
 
 type Fetcher struct {
 	Client *http.Client
+	// Timeout limits the time spent querying each OCSP responder, including
+	// reading the response; zero means no timeout (other than the Client's.)
+	Timeout time.Duration
+	// Header contains extra headers (e.g. User-Agent) sent with each request;
+	// they never override the headers set by the Fetcher itself.
+	Header http.Header
+	// ResponseValidator is called to validate responses before they're
+	// returned; if nil, DefaultResponseValidator is used.
+	ResponseValidator ResponseValidator
+	// Logger receives structured log records, using the LogKey* attributes;
+	// if nil, nothing is logged.
+	Logger *slog.Logger
+	// Metrics receives measurements of the requests to OCSP responders; if
+	// nil, they're discarded.
+	Metrics Metrics
+	// RateLimit limits the rate of requests to each OCSP responder host;
+	// requests wait for their turn (or until their context is done).
+	RateLimit RateLimit
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
 
 	time func() time.Time
 }
@@ -276,6 +718,34 @@ func (f *Fetcher) client() *http.Client {
 	return f.Client
 }
 
+func (f *Fetcher) header() http.Header {
+	if f == nil {
+		return nil
+	}
+	return f.Header
+}
+
+func (f *Fetcher) responseValidator() ResponseValidator {
+	if f == nil || f.ResponseValidator == nil {
+		return DefaultResponseValidator
+	}
+	return f.ResponseValidator
+}
+
+func (f *Fetcher) logger() *slog.Logger {
+	if f == nil || f.Logger == nil {
+		return discardLogger
+	}
+	return f.Logger
+}
+
+func (f *Fetcher) metrics() Metrics {
+	if f == nil || f.Metrics == nil {
+		return nopMetrics{}
+	}
+	return f.Metrics
+}
+
 func (f *Fetcher) now() time.Time {
 	if f == nil || f.time == nil {
 		return time.Now()
@@ -299,7 +769,27 @@ func Fetch(req *Request, etag string, lastModified, nextUpdate time.Time) (*Resp
 	return (*Fetcher)(nil).Fetch(req, etag, lastModified, nextUpdate)
 }
 
+func FetchRContext(ctx context.Context, req *Request, prev *Response) (*Response, error) {
+	return (*Fetcher)(nil).FetchRContext(ctx, req, prev)
+}
+
+func FetchContext(ctx context.Context, req *Request, etag string, lastModified, nextUpdate time.Time) (*Response, error) {
+	return (*Fetcher)(nil).FetchContext(ctx, req, etag, lastModified, nextUpdate)
+}
+
 func (f *Fetcher) FetchR(req *Request, prev *Response) (*Response, error) {
+	return f.FetchRContext(context.Background(), req, prev)
+}
+
+// FetchRContext is like FetchContext but takes the etag, lastModified and
+// nextUpdate from a previous response, if any.
+func (f *Fetcher) FetchRContext(ctx context.Context, req *Request, prev *Response) (*Response, error) {
+	return notModifiedAsNil(f.revalidate(ctx, req, prev))
+}
+
+// revalidate is like FetchRContext but returns a 304 Not Modified response
+// as a Response with a nil OCSPResponse, see parseResponse.
+func (f *Fetcher) revalidate(ctx context.Context, req *Request, prev *Response) (*Response, error) {
 	var etag string
 	var lastModified, nextUpdate time.Time
 	if prev != nil {
@@ -308,44 +798,140 @@ func (f *Fetcher) FetchR(req *Request, prev *Response) (*Response, error) {
 			nextUpdate = prev.OCSPResponse.NextUpdate
 		}
 	}
-	return f.Fetch(req, etag, lastModified, nextUpdate)
+	return f.fetchContext(ctx, req, etag, lastModified, nextUpdate)
 }
 
 func (f *Fetcher) Fetch(req *Request, etag string, lastModified, nextUpdate time.Time) (*Response, error) {
+	return f.FetchContext(context.Background(), req, etag, lastModified, nextUpdate)
+}
+
+// FetchContext queries the OCSP responders of the request, failing over from
+// one to the next on network errors, server errors, or malformed responses.
+//
+// The OCSP responder that last worked is tried first.
+//
+// Each OCSP responder is given at most f.Timeout to respond (if non-zero),
+// and the whole operation is aborted if ctx is done.
+//
+// A nil response with a nil error indicates a 304 Not Modified response.
+func (f *Fetcher) FetchContext(ctx context.Context, req *Request, etag string, lastModified, nextUpdate time.Time) (*Response, error) {
+	return notModifiedAsNil(f.fetchContext(ctx, req, etag, lastModified, nextUpdate))
+}
+
+// notModifiedAsNil turns a 304 Not Modified response into a nil response.
+func notModifiedAsNil(resp *Response, err error) (*Response, error) {
+	if resp != nil && resp.OCSPResponse == nil {
+		return nil, err
+	}
+	return resp, err
+}
+
+func (f *Fetcher) fetchContext(ctx context.Context, req *Request, etag string, lastModified, nextUpdate time.Time) (resp *Response, err error) {
 	now := f.now()
 
 	if now.After(req.notAfter) {
-		return nil, errCertExpired
+		return nil, ErrCertExpired
+	}
+
+	start := req.preferredEndpoint()
+	for i := range req.endpoints {
+		n := (start + i) % len(req.endpoints)
+		e := &req.endpoints[n]
+		f.logger().Debug("querying OCSP responder", LogKeyURL, e.url)
+		resp, err = f.fetch(ctx, req, e, etag, lastModified, nextUpdate, now)
+		if err == nil {
+			req.setPreferredEndpoint(n)
+			return resp, nil
+		}
+		attrs := []any{LogKeyURL, e.url, errorAttr(err)}
+		if se, ok := err.(HTTPStatusError); ok {
+			attrs = append(attrs, LogKeyHTTPStatus, se.StatusCode)
+		}
+		if ctx.Err() != nil || !shouldFailover(err) || i == len(req.endpoints)-1 {
+			f.logger().Debug("OCSP responder failed", attrs...)
+			break
+		}
+		f.logger().Warn("OCSP responder failed, trying the next one", attrs...)
 	}
+	return resp, err
+}
 
-	h, err := req.createHTTPRequest(etag, lastModified)
-	if err != nil {
+func (f *Fetcher) fetch(ctx context.Context, req *Request, e *endpoint, etag string, lastModified, nextUpdate, now time.Time) (*Response, error) {
+	if err := f.wait(ctx, e.host()); err != nil {
 		return nil, err
 	}
-	r, err := f.client().Do(h)
+	if f != nil && f.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, f.Timeout)
+		defer cancel()
+	}
+	h, nonce, err := req.createHTTPRequest(ctx, e, etag, lastModified)
 	if err != nil {
 		return nil, err
 	}
-	resp, err := parseResponse(r, req.issuer, now)
+	for k, v := range f.header() {
+		if _, ok := h.Header[k]; !ok {
+			h.Header[k] = append([]string(nil), v...)
+		}
+	}
+	resp, _, err := f.do(req, e, h, nonce, now)
 	if err != nil {
 		return resp, err
 	}
 
 	// GET requests might be overzealously cached by intermediaries, reattempt if stale
 	if h.Method == "GET" {
-		if resp != nil {
+		if resp.OCSPResponse != nil {
 			nextUpdate = resp.OCSPResponse.NextUpdate
 		}
 		if !nextUpdate.IsZero() && nextUpdate.Before(now) {
+			f.logger().Debug("stale OCSP response, bypassing caches", LogKeyURL, e.url)
 			h.Header.Set("Cache-Control", "no-cache")
-			r, err = f.client().Do(h)
-			if err != nil {
+			r, statusCode, err := f.do(req, e, h, nonce, now)
+			if statusCode == 0 {
 				// return previous response, even if stale (let it be handled downstream)
 				return resp, nil
 			}
-			resp, err = parseResponse(r, req.issuer, now)
+			return r, err
 		}
 	}
 
 	return resp, err
 }
+
+// do sends the HTTP request and parses the response, reporting to Metrics.
+//
+// The returned status code is zero if no HTTP response was received.
+func (f *Fetcher) do(req *Request, e *endpoint, h *http.Request, nonce []byte, now time.Time) (resp *Response, statusCode int, err error) {
+	start := time.Now()
+	defer func() {
+		f.metrics().ObserveRequest(e.host(), statusCode, fetchOutcome(resp, err), time.Since(start))
+	}()
+	r, err := f.client().Do(h)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err = f.parseResponse(req, r, nonce, now)
+	return resp, r.StatusCode, err
+}
+
+// shouldFailover determines whether another OCSP responder should be tried
+// after the given error: any error other than a client error (4xx) qualifies.
+func shouldFailover(err error) bool {
+	if s, ok := err.(HTTPStatusError); ok {
+		return s.StatusCode >= 500
+	}
+	return true
+}
+
+func (f *Fetcher) parseResponse(req *Request, r *http.Response, nonce []byte, now time.Time) (*Response, error) {
+	defer r.Body.Close()
+	resp, err := req.parseResponse(r, nonce, now)
+	if err != nil || resp.OCSPResponse == nil {
+		return resp, err
+	}
+	if err = f.responseValidator()(resp.OCSPResponse, req.issuer, now); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
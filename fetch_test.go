@@ -2,12 +2,16 @@ package ocspd
 
 import (
 	"bytes"
+	"context"
+	"crypto"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/asn1"
 	"encoding/hex"
 	"errors"
 	"io"
 	"io/ioutil"
+	"math/big"
 	"net/http"
 	"net/url"
 	"reflect"
@@ -58,12 +62,21 @@ func TestCreateRequest(t *testing.T) {
 			continue
 		}
 
-		if request.url != test.expectedURL {
-			t.Errorf("request.url: got %s, want %s", request.url, test.expectedURL)
+		if len(request.endpoints) != 1 {
+			t.Errorf("request.endpoints: got %d endpoints, want 1", len(request.endpoints))
+			continue
+		}
+
+		if e := request.endpoints[0]; e.url != test.expectedURL {
+			t.Errorf("request.url: got %s, want %s", e.url, test.expectedURL)
 		}
 
-		if !bytes.Equal(request.body, test.expectedBody) {
-			t.Errorf("request.body: got %x, want %x", request.body, test.expectedBody)
+		if e := request.endpoints[0]; !bytes.Equal(e.body, test.expectedBody) {
+			t.Errorf("request.body: got %x, want %x", e.body, test.expectedBody)
+		}
+
+		if e := request.endpoints[0]; e.responderURL != test.responderURL {
+			t.Errorf("request.responderURL: got %s, want %s", e.responderURL, test.responderURL)
 		}
 
 		if !request.notAfter.Equal(cert.NotAfter) {
@@ -73,26 +86,73 @@ func TestCreateRequest(t *testing.T) {
 		if !reflect.DeepEqual(request.issuer, issuer) {
 			t.Errorf("request.issuer: got %v, want %v", request.issuer, issuer)
 		}
+
+		if request.certID == nil || request.certID.SerialNumber.Cmp(cert.SerialNumber) != 0 {
+			t.Errorf("request.certID: got %v, want serial number %v", request.certID, cert.SerialNumber)
+		}
+	}
+}
+
+func TestCreateRequestMultipleResponders(t *testing.T) {
+	leafCert, _ := hex.DecodeString(leafCertHex)
+	cert, err := x509.ParseCertificate(leafCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issuerCert, _ := hex.DecodeString(issuerCertHex)
+	issuer, err := x509.ParseCertificate(issuerCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert.OCSPServer = []string{"http://one/", "ldap://ignored", "HTTPS://two", "ftp"}
+	request, err := CreateRequest(cert, issuer, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"http://one/" + ocspRequestBase64, "HTTPS://two/" + ocspRequestBase64}
+	var urls []string
+	for _, e := range request.endpoints {
+		urls = append(urls, e.url)
+	}
+	if !reflect.DeepEqual(urls, expected) {
+		t.Errorf("request.endpoints: got %v, want %v", urls, expected)
+	}
+
+	// fall back to the issuer's OCSP responders
+	cert.OCSPServer = nil
+	issuer.OCSPServer = []string{"http://issuer/"}
+	if request, err = CreateRequest(cert, issuer, ""); err != nil {
+		t.Fatal(err)
+	}
+	if len(request.endpoints) != 1 || request.endpoints[0].url != "http://issuer/"+ocspRequestBase64 {
+		t.Errorf("request.endpoints: got %v, want [http://issuer/%s]", request.endpoints, ocspRequestBase64)
+	}
+
+	issuer.OCSPServer = nil
+	if _, err = CreateRequest(cert, issuer, ""); err != errNoResponderURL {
+		t.Errorf("CreateRequest: error: got %v, want %v", err, errNoResponderURL)
 	}
 }
 
 func TestCreateHTTPRequest(t *testing.T) {
 	ocspRequest, _ := hex.DecodeString(ocspRequestHex)
 	tests := []struct {
-		request        *Request
+		endpoint       endpoint
 		etag           string
 		lastModified   time.Time
 		expectedMethod string
 	}{
 		{
-			request: &Request{
+			endpoint: endpoint{
 				url: "http://respo.nd/er/" + ocspRequestBase64,
 			},
 			etag:           `"etag string"`,
 			expectedMethod: "GET",
 		},
 		{
-			request: &Request{
+			endpoint: endpoint{
 				url:  "http://respo.nd/er/",
 				body: ocspRequest,
 			},
@@ -101,11 +161,14 @@ func TestCreateHTTPRequest(t *testing.T) {
 	}
 
 	for _, test := range tests {
-		request, err := test.request.createHTTPRequest(test.etag, test.lastModified)
+		request, nonce, err := (&Request{}).createHTTPRequest(context.Background(), &test.endpoint, test.etag, test.lastModified)
 		if err != nil {
 			t.Error(err)
 			continue
 		}
+		if nonce != nil {
+			t.Errorf("nonce: got %x, want nil", nonce)
+		}
 
 		if request.Method != test.expectedMethod {
 			t.Errorf("request.Method: got %s, want %s", request.Method, test.expectedMethod)
@@ -120,20 +183,20 @@ func TestCreateHTTPRequest(t *testing.T) {
 			}
 			t.Errorf("If-None-Match: got %s, want %s", ims, lm)
 		}
-		if request.ContentLength != 0 && request.ContentLength != int64(len(test.request.body)) {
-			t.Errorf("request.ContentLength: got %d, want %d", request.ContentLength, len(test.request.body))
+		if request.ContentLength != 0 && request.ContentLength != int64(len(test.endpoint.body)) {
+			t.Errorf("request.ContentLength: got %d, want %d", request.ContentLength, len(test.endpoint.body))
 		}
 		if request.Body != nil {
 			if body, err := ioutil.ReadAll(request.Body); err != nil {
 				t.Error(err)
-			} else if !bytes.Equal(body, test.request.body) {
-				t.Errorf("request.Body: got %x, want %x", body, test.request.body)
+			} else if !bytes.Equal(body, test.endpoint.body) {
+				t.Errorf("request.Body: got %x, want %x", body, test.endpoint.body)
 			}
 			if err := request.Body.Close(); err != nil {
 				t.Error(err)
 			}
-		} else if test.request.body != nil {
-			t.Errorf("request.Body: got nil, want %x", test.request.body)
+		} else if test.endpoint.body != nil {
+			t.Errorf("request.Body: got nil, want %x", test.endpoint.body)
 		}
 	}
 }
@@ -244,6 +307,136 @@ func TestMaxAge(t *testing.T) {
 	}
 }
 
+func TestFreshness(t *testing.T) {
+	now := time.Date(2016, 1, 10, 22, 44, 0, 0, time.UTC)
+
+	tests := []struct {
+		input    http.Header
+		expected freshness
+	}{
+		{
+			input: http.Header{},
+		},
+		{
+			input:    http.Header{"Cache-Control": {"max-age=3600"}, "Age": {"600"}},
+			expected: freshness{maxAge: now.Add(50 * time.Minute)},
+		},
+		{
+			// Date already accounts for some of the age
+			input: http.Header{
+				"Date":          {"Sun, 10 Jan 2016 22:34:00 GMT"},
+				"Cache-Control": {"max-age=3600"},
+				"Age":           {"300"},
+			},
+			expected: freshness{maxAge: now.Add(50 * time.Minute)},
+		},
+		{
+			input: http.Header{
+				"Date":          {"Sun, 10 Jan 2016 22:34:00 GMT"},
+				"Cache-Control": {"max-age=3600"},
+				"Age":           {"900"},
+			},
+			expected: freshness{maxAge: now.Add(45 * time.Minute)},
+		},
+		{
+			input:    http.Header{"Cache-Control": {"max-age=3600"}, "Age": {"invalid value"}},
+			expected: freshness{maxAge: now.Add(time.Hour)},
+		},
+		{
+			input:    http.Header{"Expires": {"Sun, 10 Jan 2016 23:44:00 GMT"}, "Age": {"600"}},
+			expected: freshness{maxAge: now.Add(50 * time.Minute)},
+		},
+		{
+			input:    http.Header{"Cache-Control": {"max-age=3600, s-maxage=600"}},
+			expected: freshness{maxAge: now.Add(10 * time.Minute)},
+		},
+		{
+			input:    http.Header{"Cache-Control": {"s-maxage=7200, max-age=600"}},
+			expected: freshness{maxAge: now.Add(2 * time.Hour)},
+		},
+		{
+			input: http.Header{"Cache-Control": {"max-age=3600, stale-while-revalidate=600, stale-if-error=86400"}},
+			expected: freshness{
+				maxAge:               now.Add(time.Hour),
+				staleWhileRevalidate: now.Add(70 * time.Minute),
+				staleIfError:         now.Add(25 * time.Hour),
+			},
+		},
+		{
+			input: http.Header{"Cache-Control": {"stale-if-error=86400"}, "Expires": {"Sun, 10 Jan 2016 23:44:00 GMT"}},
+			expected: freshness{
+				maxAge:       now.Add(time.Hour),
+				staleIfError: now.Add(25 * time.Hour),
+			},
+		},
+		{
+			// no max-age
+			input: http.Header{"Cache-Control": {"stale-while-revalidate=600, stale-if-error=86400"}},
+		},
+		{
+			input:    http.Header{"Cache-Control": {"max-age=3600, must-revalidate, stale-while-revalidate=600, stale-if-error=86400"}},
+			expected: freshness{maxAge: now.Add(time.Hour)},
+		},
+		{
+			// s-maxage implies proxy-revalidate
+			input:    http.Header{"Cache-Control": {"s-maxage=3600, stale-if-error=86400"}},
+			expected: freshness{maxAge: now.Add(time.Hour)},
+		},
+		{
+			input:    http.Header{"Cache-Control": {"max-age=3600, No-Cache, stale-if-error=86400"}},
+			expected: freshness{maxAge: now},
+		},
+		{
+			input:    http.Header{"Cache-Control": {"max-age=3600, NO-STORE"}},
+			expected: freshness{maxAge: now.Add(time.Hour), noStore: true},
+		},
+	}
+	for _, test := range tests {
+		f := parseFreshness(test.input, now)
+		if !f.maxAge.Equal(test.expected.maxAge) || !f.staleWhileRevalidate.Equal(test.expected.staleWhileRevalidate) ||
+			!f.staleIfError.Equal(test.expected.staleIfError) || f.noStore != test.expected.noStore {
+			t.Errorf("parseFreshness(%v): got %+v, want %+v", test.input, f, test.expected)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2016, 1, 10, 22, 44, 0, 0, time.UTC)
+
+	tests := []struct {
+		input    http.Header
+		expected time.Time
+	}{
+		{
+			input: http.Header{},
+		},
+		{
+			input:    http.Header{"Retry-After": {"120"}},
+			expected: now.Add(2 * time.Minute),
+		},
+		{
+			input:    http.Header{"Retry-After": {"0"}},
+			expected: now,
+		},
+		{
+			input: http.Header{"Retry-After": {"-1"}},
+		},
+		{
+			input:    http.Header{"Retry-After": {"Sun, 10 Jan 2016 23:00:00 GMT"}},
+			expected: time.Date(2016, 1, 10, 23, 0, 0, 0, time.UTC),
+		},
+		{
+			input: http.Header{"Retry-After": {"invalid value"}},
+		},
+	}
+	for _, test := range tests {
+		r := retryAfter(test.input, now)
+		if !r.Equal(test.expected) {
+			t.Errorf("retryAfter(%v): got %v, want %v", test.input, r, test.expected)
+		}
+	}
+}
+
 func TestParseResponse(t *testing.T) {
 	ocspResponse, _ := hex.DecodeString(ocspResponseHex)
 	parsedOCSPResponse, err := ocsp.ParseResponse(ocspResponse, nil)
@@ -268,7 +461,22 @@ func TestParseResponse(t *testing.T) {
 			input: http.Response{
 				StatusCode: http.StatusNotModified,
 			},
-			expected: nil,
+			expected: &Response{},
+		},
+		{
+			input: http.Response{
+				StatusCode: http.StatusNotModified,
+				Header: http.Header{
+					"Date":          {now.Format(http.TimeFormat)},
+					"Cache-Control": {"max-age=600, stale-if-error=3600"},
+					"Etag":          {`"the etag"`},
+				},
+			},
+			expected: &Response{
+				MaxAge:       now.Add(10 * time.Minute),
+				StaleIfError: now.Add(70 * time.Minute),
+				Etag:         `"the etag"`,
+			},
 		},
 		{
 			input: http.Response{
@@ -277,7 +485,25 @@ func TestParseResponse(t *testing.T) {
 				ContentLength: 0,
 				Body:          ioutil.NopCloser(bytes.NewReader(nil)),
 			},
-			expectedErr: errBadHTTPStatus(404),
+			expectedErr: HTTPStatusError{StatusCode: 404},
+		},
+		{
+			input: http.Response{
+				StatusCode:    http.StatusServiceUnavailable,
+				Header:        http.Header{"Retry-After": {"120"}},
+				ContentLength: 0,
+				Body:          ioutil.NopCloser(bytes.NewReader(nil)),
+			},
+			expectedErr: HTTPStatusError{StatusCode: 503, RetryAfter: now.Add(2 * time.Minute)},
+		},
+		{
+			input: http.Response{
+				StatusCode:    http.StatusNotFound,
+				Header:        http.Header{"Retry-After": {"120"}},
+				ContentLength: 0,
+				Body:          ioutil.NopCloser(bytes.NewReader(nil)),
+			},
+			expectedErr: HTTPStatusError{StatusCode: 404},
 		},
 		{
 			input: http.Response{
@@ -406,16 +632,45 @@ func TestFetch(t *testing.T) {
 	}
 
 	getRequest := &Request{
-		url:      "http://respo.nd/er/" + ocspRequestBase64,
-		notAfter: cert.NotAfter,
-		issuer:   issuer,
+		endpoints: []endpoint{{url: "http://respo.nd/er/" + ocspRequestBase64}},
+		notAfter:  cert.NotAfter,
+		issuer:    issuer,
 	}
 
 	postRequest := &Request{
-		url:      "http://respo.nd/er/",
-		body:     ocspResponse,
-		notAfter: cert.NotAfter,
-		issuer:   issuer,
+		endpoints: []endpoint{{url: "http://respo.nd/er/", body: ocspResponse}},
+		notAfter:  cert.NotAfter,
+		issuer:    issuer,
+	}
+
+	responseNameHash, _ := hex.DecodeString("6568874f40750f016a3475625e1f5c93e5a26d58")
+	responseKeyHash, _ := hex.DecodeString("eb4234d098b0ab9ff41b6b08f7cc642eef0e2c45")
+	matchingRequest := &Request{
+		endpoints: getRequest.endpoints,
+		notAfter:  cert.NotAfter,
+		issuer:    issuer,
+		certID: &ocsp.Request{
+			HashAlgorithm:  crypto.SHA1,
+			IssuerNameHash: responseNameHash,
+			IssuerKeyHash:  responseKeyHash,
+			SerialNumber:   parsedOCSPResponse.SerialNumber,
+		},
+	}
+
+	mismatchingRequest, err := CreateRequest(cert, issuer, "http://respo.nd/er")
+	if err != nil {
+		t.Fatal(err)
+	}
+	badKeyHashRequest := &Request{
+		endpoints: getRequest.endpoints,
+		notAfter:  cert.NotAfter,
+		issuer:    issuer,
+		certID: &ocsp.Request{
+			HashAlgorithm:  crypto.SHA1,
+			IssuerNameHash: responseNameHash,
+			IssuerKeyHash:  make([]byte, len(responseKeyHash)),
+			SerialNumber:   parsedOCSPResponse.SerialNumber,
+		},
 	}
 
 	tests := []struct {
@@ -503,7 +758,7 @@ func TestFetch(t *testing.T) {
 		},
 		{
 			now:         cert.NotAfter.Add(1 * time.Hour),
-			expectedErr: errCertExpired,
+			expectedErr: ErrCertExpired,
 			action: func(n int, req *http.Request) (*http.Response, error) {
 				return nil, errors.New("Unexpected request")
 			},
@@ -512,7 +767,7 @@ func TestFetch(t *testing.T) {
 			requests: []*Request{getRequest},
 			expectedErr: &url.Error{
 				Op:  "Get",
-				URL: getRequest.url,
+				URL: getRequest.endpoints[0].url,
 				Err: errors.New("test error"),
 			},
 			action: func(n int, req *http.Request) (*http.Response, error) {
@@ -523,7 +778,7 @@ func TestFetch(t *testing.T) {
 			requests: []*Request{postRequest},
 			expectedErr: &url.Error{
 				Op:  "Post",
-				URL: postRequest.url,
+				URL: postRequest.endpoints[0].url,
 				Err: errors.New("test error"),
 			},
 			action: func(n int, req *http.Request) (*http.Response, error) {
@@ -579,7 +834,7 @@ func TestFetch(t *testing.T) {
 		{
 			requests:        []*Request{getRequest},
 			now:             parsedOCSPResponse.NextUpdate.Add(1 * time.Hour),
-			expectedErr:     errBadHTTPStatus(500),
+			expectedErr:     HTTPStatusError{StatusCode: 500},
 			expectSecondReq: true,
 			action: func(n int, req *http.Request) (*http.Response, error) {
 				switch n {
@@ -628,6 +883,51 @@ func TestFetch(t *testing.T) {
 				}
 			},
 		},
+		{
+			requests: []*Request{matchingRequest},
+			now:      parsedOCSPResponse.ThisUpdate.Add(parsedOCSPResponse.NextUpdate.Sub(parsedOCSPResponse.ThisUpdate) / 2),
+			expected: &Response{
+				OCSPResponse:    parsedOCSPResponse,
+				RawOCSPResponse: ocspResponse,
+			},
+			action: func(n int, req *http.Request) (*http.Response, error) {
+				resp := &http.Response{
+					StatusCode:    http.StatusOK,
+					Header:        http.Header{"Content-Type": {"application/ocsp-response"}},
+					ContentLength: int64(len(ocspResponse)),
+					Body:          ioutil.NopCloser(bytes.NewReader(ocspResponse)),
+				}
+				return resp, nil
+			},
+		},
+		{
+			requests:    []*Request{mismatchingRequest},
+			now:         parsedOCSPResponse.ThisUpdate.Add(parsedOCSPResponse.NextUpdate.Sub(parsedOCSPResponse.ThisUpdate) / 2),
+			expectedErr: errResponseMismatch("serial number"),
+			action: func(n int, req *http.Request) (*http.Response, error) {
+				resp := &http.Response{
+					StatusCode:    http.StatusOK,
+					Header:        http.Header{"Content-Type": {"application/ocsp-response"}},
+					ContentLength: int64(len(ocspResponse)),
+					Body:          ioutil.NopCloser(bytes.NewReader(ocspResponse)),
+				}
+				return resp, nil
+			},
+		},
+		{
+			requests:    []*Request{badKeyHashRequest},
+			now:         parsedOCSPResponse.ThisUpdate.Add(parsedOCSPResponse.NextUpdate.Sub(parsedOCSPResponse.ThisUpdate) / 2),
+			expectedErr: errResponseMismatch("issuer key hash"),
+			action: func(n int, req *http.Request) (*http.Response, error) {
+				resp := &http.Response{
+					StatusCode:    http.StatusOK,
+					Header:        http.Header{"Content-Type": {"application/ocsp-response"}},
+					ContentLength: int64(len(ocspResponse)),
+					Body:          ioutil.NopCloser(bytes.NewReader(ocspResponse)),
+				}
+				return resp, nil
+			},
+		},
 		{
 			requests: []*Request{postRequest},
 			now:      parsedOCSPResponse.NextUpdate.Add(1 * time.Hour),
@@ -687,6 +987,412 @@ func TestFetch(t *testing.T) {
 	}
 }
 
+func TestFetchFailover(t *testing.T) {
+	ocspResponse, _ := hex.DecodeString(ocspResponseHex)
+	parsedOCSPResponse, err := ocsp.ParseResponse(ocspResponse, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issuerCert, _ := hex.DecodeString(startComHex)
+	issuer, err := x509.ParseCertificate(issuerCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := parsedOCSPResponse.ThisUpdate.Add(parsedOCSPResponse.NextUpdate.Sub(parsedOCSPResponse.ThisUpdate) / 2)
+
+	ok := func() *http.Response {
+		return &http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        http.Header{"Content-Type": {"application/ocsp-response"}},
+			ContentLength: int64(len(ocspResponse)),
+			Body:          ioutil.NopCloser(bytes.NewReader(ocspResponse)),
+		}
+	}
+	status := func(code int) *http.Response {
+		return &http.Response{
+			StatusCode: code,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+	}
+
+	tests := []struct {
+		name              string
+		responses         map[string]func() (*http.Response, error)
+		expectedErr       error
+		expectedHosts     []string
+		expectedPreferred int
+	}{
+		{
+			name: "first responder works",
+			responses: map[string]func() (*http.Response, error){
+				"one": func() (*http.Response, error) { return ok(), nil },
+			},
+			expectedHosts:     []string{"one"},
+			expectedPreferred: 0,
+		},
+		{
+			name: "fail over on network errors and server errors",
+			responses: map[string]func() (*http.Response, error){
+				"one":   func() (*http.Response, error) { return nil, errors.New("test error") },
+				"two":   func() (*http.Response, error) { return status(http.StatusServiceUnavailable), nil },
+				"three": func() (*http.Response, error) { return ok(), nil },
+			},
+			expectedHosts:     []string{"one", "two", "three"},
+			expectedPreferred: 2,
+		},
+		{
+			name: "fail over on malformed responses",
+			responses: map[string]func() (*http.Response, error){
+				"one": func() (*http.Response, error) {
+					resp := ok()
+					resp.Header = http.Header{}
+					return resp, nil
+				},
+				"two": func() (*http.Response, error) { return ok(), nil },
+			},
+			expectedHosts:     []string{"one", "two"},
+			expectedPreferred: 1,
+		},
+		{
+			name: "no fail over on client errors",
+			responses: map[string]func() (*http.Response, error){
+				"one": func() (*http.Response, error) { return status(http.StatusNotFound), nil },
+			},
+			expectedErr:   HTTPStatusError{StatusCode: http.StatusNotFound},
+			expectedHosts: []string{"one"},
+		},
+		{
+			name: "all responders fail",
+			responses: map[string]func() (*http.Response, error){
+				"one":   func() (*http.Response, error) { return status(http.StatusInternalServerError), nil },
+				"two":   func() (*http.Response, error) { return status(http.StatusInternalServerError), nil },
+				"three": func() (*http.Response, error) { return status(http.StatusBadGateway), nil },
+			},
+			expectedErr:   HTTPStatusError{StatusCode: http.StatusBadGateway},
+			expectedHosts: []string{"one", "two", "three"},
+		},
+	}
+
+	for _, test := range tests {
+		req := &Request{
+			endpoints: []endpoint{
+				{url: "http://one/" + ocspRequestBase64},
+				{url: "http://two/" + ocspRequestBase64},
+				{url: "http://three/" + ocspRequestBase64},
+			},
+			notAfter: now.Add(24 * time.Hour),
+			issuer:   issuer,
+		}
+		var hosts []string
+		f := Fetcher{
+			Client: &http.Client{
+				Transport: &countingRoundTripper{
+					f: func(n int, r *http.Request) (*http.Response, error) {
+						hosts = append(hosts, r.URL.Host)
+						if resp, ok := test.responses[r.URL.Host]; ok {
+							return resp()
+						}
+						return nil, errors.New("unexpected request")
+					},
+				},
+			},
+			time: func() time.Time { return now },
+		}
+		_, err := f.Fetch(req, "", time.Time{}, time.Time{})
+		if err != nil {
+			if urlErr, ok := err.(*url.Error); ok {
+				err = urlErr.Err
+			}
+			if !reflect.DeepEqual(err, test.expectedErr) {
+				t.Errorf("%s: fetcher.Fetch: error: got %v, want %v", test.name, err, test.expectedErr)
+			}
+		} else if test.expectedErr != nil {
+			t.Errorf("%s: fetcher.Fetch: error: got nil, want %v", test.name, test.expectedErr)
+		}
+		if !reflect.DeepEqual(hosts, test.expectedHosts) {
+			t.Errorf("%s: fetcher.Fetch: queried %v, want %v", test.name, hosts, test.expectedHosts)
+		}
+		if p := req.preferredEndpoint(); p != test.expectedPreferred {
+			t.Errorf("%s: preferred endpoint: got %d, want %d", test.name, p, test.expectedPreferred)
+		}
+
+		if test.expectedErr == nil {
+			// the responder that worked is tried first next time
+			hosts = nil
+			if _, err := f.Fetch(req, "", time.Time{}, time.Time{}); err != nil {
+				t.Errorf("%s: fetcher.Fetch: %v", test.name, err)
+			}
+			if len(hosts) != 1 || hosts[0] != test.expectedHosts[len(test.expectedHosts)-1] {
+				t.Errorf("%s: fetcher.Fetch: queried %v, want %v", test.name, hosts, test.expectedHosts[len(test.expectedHosts)-1:])
+			}
+		}
+	}
+}
+
+func TestFetchContext(t *testing.T) {
+	ocspResponse, _ := hex.DecodeString(ocspResponseHex)
+	parsedOCSPResponse, err := ocsp.ParseResponse(ocspResponse, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issuerCert, _ := hex.DecodeString(startComHex)
+	issuer, err := x509.ParseCertificate(issuerCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := parsedOCSPResponse.ThisUpdate.Add(parsedOCSPResponse.NextUpdate.Sub(parsedOCSPResponse.ThisUpdate) / 2)
+
+	req := &Request{
+		endpoints: []endpoint{
+			{url: "http://slow/" + ocspRequestBase64},
+			{url: "http://fast/" + ocspRequestBase64},
+		},
+		notAfter: now.Add(24 * time.Hour),
+		issuer:   issuer,
+	}
+	var hosts []string
+	f := Fetcher{
+		Client: &http.Client{
+			Transport: &countingRoundTripper{
+				f: func(n int, r *http.Request) (*http.Response, error) {
+					hosts = append(hosts, r.URL.Host)
+					if r.URL.Host == "slow" {
+						<-r.Context().Done()
+						return nil, r.Context().Err()
+					}
+					return &http.Response{
+						StatusCode:    http.StatusOK,
+						Header:        http.Header{"Content-Type": {"application/ocsp-response"}},
+						ContentLength: int64(len(ocspResponse)),
+						Body:          ioutil.NopCloser(bytes.NewReader(ocspResponse)),
+					}, nil
+				},
+			},
+		},
+		Timeout: 10 * time.Millisecond,
+		time:    func() time.Time { return now },
+	}
+
+	// timing out on a responder fails over to the next one
+	if _, err := f.FetchContext(context.Background(), req, "", time.Time{}, time.Time{}); err != nil {
+		t.Errorf("fetcher.FetchContext: %v", err)
+	}
+	if expected := []string{"slow", "fast"}; !reflect.DeepEqual(hosts, expected) {
+		t.Errorf("fetcher.FetchContext: queried %v, want %v", hosts, expected)
+	}
+
+	// a done context aborts the fetch without failing over
+	hosts = nil
+	req.setPreferredEndpoint(0)
+	f.Timeout = 0
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := f.FetchContext(ctx, req, "", time.Time{}, time.Time{}); err == nil {
+		t.Error("fetcher.FetchContext: expected an error")
+	} else if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("fetcher.FetchContext: error: got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if expected := []string{"slow"}; !reflect.DeepEqual(hosts, expected) {
+		t.Errorf("fetcher.FetchContext: queried %v, want %v", hosts, expected)
+	}
+}
+
+func TestFetchHeader(t *testing.T) {
+	var header http.Header
+	f := Fetcher{
+		Header: http.Header{
+			"User-Agent":    {"ocspd-test"},
+			"X-Foo":         {"bar", "baz"},
+			"If-None-Match": {`"overridden"`},
+		},
+		Client: &http.Client{
+			Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				header = r.Header
+				return &http.Response{
+					StatusCode: http.StatusNotModified,
+					Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+				}, nil
+			}),
+		},
+	}
+	req := &Request{
+		endpoints: []endpoint{{url: "http://respo.nd/er/abc"}},
+		notAfter:  time.Now().Add(24 * time.Hour),
+	}
+	if _, err := f.FetchR(req, &Response{Etag: `"etag"`}); err != nil {
+		t.Fatal(err)
+	}
+	if expected := (http.Header{
+		"User-Agent":    {"ocspd-test"},
+		"X-Foo":         {"bar", "baz"},
+		"If-None-Match": {`"etag"`},
+	}); !reflect.DeepEqual(header, expected) {
+		t.Errorf("fetcher.FetchR: sent headers %v, want %v", header, expected)
+	}
+}
+
+func TestFetchWithNonce(t *testing.T) {
+	responderCertBytes, _ := hex.DecodeString(responderCertHex)
+	responderCert, err := x509.ParseCertificate(responderCertBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	responderKeyBytes, _ := hex.DecodeString(responderPrivateKeyHex)
+	responderKey, err := x509.ParsePKCS1PrivateKey(responderKeyBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2015, 6, 1, 0, 0, 0, 0, time.UTC)
+	cert := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		NotAfter:     now.AddDate(1, 0, 0),
+	}
+
+	if _, err := CreateRequestWithOptions(cert, responderCert, &RequestOptions{ResponderURL: "http://respo.nd/er", Nonce: true, NonceLength: 33}); err != errBadNonceLength {
+		t.Errorf("CreateRequestWithOptions: error: got %v, want %v", err, errBadNonceLength)
+	}
+
+	req, err := CreateRequestWithOptions(cert, responderCert, &RequestOptions{ResponderURL: "http://respo.nd/er", Nonce: true, NonceLength: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		nonce       func([]byte) []byte
+		expectedErr error
+	}{
+		{
+			name:  "echoed nonce",
+			nonce: func(n []byte) []byte { return n },
+		},
+		{
+			name:        "different nonce",
+			nonce:       func(n []byte) []byte { return make([]byte, len(n)) },
+			expectedErr: errResponseMismatch("nonce"),
+		},
+		{
+			name:        "missing nonce",
+			nonce:       func(n []byte) []byte { return nil },
+			expectedErr: errResponseMismatch("missing nonce"),
+		},
+	}
+	for _, test := range tests {
+		crt := countingRoundTripper{
+			f: func(n int, r *http.Request) (*http.Response, error) {
+				if r.Method != "POST" {
+					t.Errorf("%s: method: got %s, want POST", test.name, r.Method)
+				}
+				body, err := ioutil.ReadAll(r.Body)
+				if err != nil {
+					return nil, err
+				}
+				var ocspReq ocspRequest
+				if _, err := asn1.Unmarshal(body, &ocspReq); err != nil {
+					return nil, err
+				}
+				if len(ocspReq.TBSRequest.RequestExtensions) != 1 || !ocspReq.TBSRequest.RequestExtensions[0].Id.Equal(idPKIXOCSPNonce) {
+					t.Errorf("%s: request extensions: got %v, want a nonce", test.name, ocspReq.TBSRequest.RequestExtensions)
+					return nil, errors.New("missing nonce in request")
+				}
+				var nonce []byte
+				if _, err := asn1.Unmarshal(ocspReq.TBSRequest.RequestExtensions[0].Value, &nonce); err != nil {
+					return nil, err
+				}
+				if len(nonce) != 16 {
+					t.Errorf("%s: nonce length: got %d, want 16", test.name, len(nonce))
+				}
+				template := ocsp.Response{
+					Status:       ocsp.Good,
+					SerialNumber: cert.SerialNumber,
+					ThisUpdate:   now.Add(-1 * time.Hour),
+					NextUpdate:   now.Add(1 * time.Hour),
+				}
+				if echoed := test.nonce(nonce); echoed != nil {
+					value, _ := asn1.Marshal(echoed)
+					template.ExtraExtensions = []pkix.Extension{{Id: idPKIXOCSPNonce, Value: value}}
+				}
+				resp, err := ocsp.CreateResponse(responderCert, responderCert, template, responderKey)
+				if err != nil {
+					return nil, err
+				}
+				return &http.Response{
+					StatusCode:    http.StatusOK,
+					Header:        http.Header{"Content-Type": {"application/ocsp-response"}},
+					ContentLength: int64(len(resp)),
+					Body:          ioutil.NopCloser(bytes.NewReader(resp)),
+				}, nil
+			},
+		}
+		f := Fetcher{
+			Client: &http.Client{
+				Transport: &crt,
+			},
+			time: func() time.Time { return now },
+		}
+		// the etag must be ignored
+		resp, err := f.Fetch(req, `"the etag"`, time.Time{}, time.Time{})
+		if !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("%s: fetcher.Fetch: error: got %v, want %v", test.name, err, test.expectedErr)
+			continue
+		}
+		if err == nil && resp.OCSPResponse.SerialNumber.Cmp(cert.SerialNumber) != 0 {
+			t.Errorf("%s: fetcher.Fetch: got serial number %v, want %v", test.name, resp.OCSPResponse.SerialNumber, cert.SerialNumber)
+		}
+	}
+}
+
+func TestCheckNonce(t *testing.T) {
+	nonce := []byte("0123456789abcdef")
+	encoded, _ := asn1.Marshal(nonce)
+	tests := []struct {
+		data        responseData
+		expectedErr error
+	}{
+		{
+			data: responseData{
+				Responses:          []singleResponse{{}},
+				ResponseExtensions: []pkix.Extension{{Id: idPKIXOCSPNonce, Value: encoded}},
+			},
+		},
+		{
+			// pre-RFC 8954 encoding
+			data: responseData{
+				Responses:          []singleResponse{{}},
+				ResponseExtensions: []pkix.Extension{{Id: idPKIXOCSPNonce, Value: nonce}},
+			},
+		},
+		{
+			data: responseData{
+				Responses: []singleResponse{{SingleExtensions: []pkix.Extension{{Id: idPKIXOCSPNonce, Value: encoded}}}},
+			},
+		},
+		{
+			data: responseData{
+				Responses:          []singleResponse{{}},
+				ResponseExtensions: []pkix.Extension{{Id: idPKIXOCSPNonce, Value: encoded[:len(encoded)-1]}},
+			},
+			expectedErr: errResponseMismatch("nonce"),
+		},
+		{
+			data: responseData{
+				Responses: []singleResponse{{}},
+			},
+			expectedErr: errResponseMismatch("missing nonce"),
+		},
+	}
+	for i, test := range tests {
+		if err := checkNonce(&test.data, nonce); err != test.expectedErr {
+			t.Errorf("checkNonce #%d: got %v, want %v", i, err, test.expectedErr)
+		}
+	}
+}
+
 // ocspRequestBase64 is ocspRequestHex decoded to bytes, then encoded to Base64, and finally URL-encoded.
 // Note that it contains all Base64 non-URL-safe characters +, / and =
 const ocspRequestBase64 = "MFEwTzBNMEswSTAJBgUrDgMCGgUABBTA%2FgJ4%2FJkYiJGz8hLpx%2BGyGre%2FwAQUDfwd" +
@@ -0,0 +1,5 @@
+module github.com/tbroyer/ocspd
+
+go 1.21
+
+require golang.org/x/crypto v0.31.0
@@ -0,0 +1,219 @@
+package ocspd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// DiskCache is an http.RoundTripper caching the successful responses to GET
+// requests on disk, keyed by URL, so that they can be shared by several
+// processes (e.g. update-ocsp invocations and ocspd on the same host.)
+//
+// Cached responses are fresh as long as allowed by their Cache-Control or
+// Expires headers (as for Response.MaxAge), and are served with an Age header;
+// stale responses, or responses to requests with a Cache-Control: no-cache
+// header, are revalidated with a conditional request. If revalidation fails
+// (network error or 5xx status), the stale response is served instead if
+// allowed by its stale-if-error Cache-Control directive. Conditional requests
+// (If-None-Match or If-Modified-Since) are answered with 304 Not Modified when
+// they match the cached response.
+//
+// POST requests, as well as responses with a Cache-Control: no-store header,
+// are never cached.
+type DiskCache struct {
+	// Dir is the directory where the responses are stored; it must exist.
+	Dir string
+	// Transport is used to send the requests; if nil, http.DefaultTransport
+	// is used.
+	Transport http.RoundTripper
+
+	time func() time.Time
+}
+
+// NewDiskCache returns a DiskCache storing responses in dir, and sending
+// requests through transport.
+func NewDiskCache(dir string, transport http.RoundTripper) *DiskCache {
+	return &DiskCache{
+		Dir:       dir,
+		Transport: transport,
+	}
+}
+
+func (c *DiskCache) transport() http.RoundTripper {
+	if c.Transport == nil {
+		return http.DefaultTransport
+	}
+	return c.Transport
+}
+
+func (c *DiskCache) now() time.Time {
+	if c.time == nil {
+		return time.Now()
+	}
+	return c.time()
+}
+
+func (c *DiskCache) filename(req *http.Request) string {
+	h := sha256.Sum256([]byte(req.URL.String()))
+	return filepath.Join(c.Dir, hex.EncodeToString(h[:]))
+}
+
+func (c *DiskCache) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet {
+		return c.transport().RoundTrip(req)
+	}
+	filename := c.filename(req)
+	cached, storedAt := c.load(filename, req)
+	now := c.now()
+	var f freshness
+	if cached != nil {
+		f = parseFreshness(cached.Header, storedAt)
+		if !hasCacheDirective(req.Header, "no-cache") && f.maxAge.After(now) {
+			return answer(req, cached, now.Sub(storedAt)), nil
+		}
+	}
+
+	// (re)validate
+	upstream := req
+	if cached != nil {
+		upstream = req.Clone(req.Context())
+		upstream.Header.Del("If-None-Match")
+		upstream.Header.Del("If-Modified-Since")
+		if etag := cached.Header.Get("ETag"); etag != "" {
+			upstream.Header.Set("If-None-Match", etag)
+		}
+		if lm := cached.Header.Get("Last-Modified"); lm != "" {
+			upstream.Header.Set("If-Modified-Since", lm)
+		}
+	}
+	resp, err := c.transport().RoundTrip(upstream)
+	if cached != nil && f.staleIfError.After(now) && (err != nil || resp.StatusCode >= 500) {
+		// keep using the stale response, as allowed by stale-if-error
+		if err == nil {
+			resp.Body.Close()
+		}
+		return answer(req, cached, now.Sub(storedAt)), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotModified && cached != nil:
+		resp.Body.Close()
+		// update the cached response's freshness
+		cached.Header.Del("Date")
+		cached.Header.Del("Age")
+		for _, k := range []string{"Cache-Control", "Date", "Age", "Expires", "ETag", "Last-Modified"} {
+			if v, ok := resp.Header[k]; ok {
+				cached.Header[k] = v
+			}
+		}
+		c.store(filename, cached, now)
+		return answer(req, cached, 0), nil
+	case resp.StatusCode == http.StatusOK && !parseFreshness(resp.Header, now).noStore:
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		stored := *resp
+		stored.Body = ioutil.NopCloser(bytes.NewReader(body))
+		c.store(filename, &stored, now)
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	return resp, nil
+}
+
+// load reads the cached response for the request, if any, along with the
+// time it was stored.
+func (c *DiskCache) load(filename string, req *http.Request) (*http.Response, time.Time) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, time.Time{}
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, time.Time{}
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(f), req)
+	if err != nil {
+		return nil, time.Time{}
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, time.Time{}
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return resp, stat.ModTime()
+}
+
+// store writes the response to the cache; errors are ignored, as the cache is
+// only an optimization.
+func (c *DiskCache) store(filename string, resp *http.Response, storedAt time.Time) {
+	b, err := httputil.DumpResponse(resp, true)
+	if err != nil {
+		return
+	}
+	if err := WriteFileAtomic(filename, b, 0600); err != nil {
+		return
+	}
+	_ = os.Chtimes(filename, storedAt, storedAt)
+}
+
+// answer returns the cached response, or a 304 Not Modified response if the
+// request is conditional and matches it, after adding the time it's been
+// stored to its Age.
+func answer(req *http.Request, cached *http.Response, stored time.Duration) *http.Response {
+	if stored >= time.Second {
+		age, _ := strconv.Atoi(cached.Header.Get("Age"))
+		if age < 0 {
+			age = 0
+		}
+		cached.Header.Set("Age", strconv.Itoa(age+int(stored/time.Second)))
+	}
+	notModified := false
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		notModified = inm == cached.Header.Get("ETag")
+	} else if ims := req.Header.Get("If-Modified-Since"); ims != "" {
+		t, err := http.ParseTime(ims)
+		lm, lerr := http.ParseTime(cached.Header.Get("Last-Modified"))
+		notModified = err == nil && lerr == nil && !lm.After(t)
+	}
+	if !notModified {
+		return cached
+	}
+	cached.Body.Close()
+	return &http.Response{
+		Status:     "304 Not Modified",
+		StatusCode: http.StatusNotModified,
+		Proto:      cached.Proto,
+		ProtoMajor: cached.ProtoMajor,
+		ProtoMinor: cached.ProtoMinor,
+		Header:     cached.Header,
+		Body:       http.NoBody,
+		Request:    req,
+	}
+}
+
+func hasCacheDirective(h http.Header, directive string) bool {
+	for _, cc := range h["Cache-Control"] {
+		for rest := cc; rest != ""; {
+			var k string
+			k, _, rest = consumeCacheControlDirective(rest)
+			if k == directive {
+				return true
+			}
+		}
+	}
+	return false
+}
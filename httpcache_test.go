@@ -0,0 +1,119 @@
+package ocspd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiskCache(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	var requests []*http.Request
+	var status int
+	var header http.Header
+	c := NewDiskCache(t.TempDir(), roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		requests = append(requests, r)
+		return &http.Response{
+			StatusCode: status,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     header.Clone(),
+			Body:       ioutil.NopCloser(strings.NewReader("response")),
+		}, nil
+	}))
+	c.time = func() time.Time { return now }
+
+	get := func(url string, h ...string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		for i := 0; i < len(h); i += 2 {
+			req.Header.Set(h[i], h[i+1])
+		}
+		resp, err := c.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	expect := func(resp *http.Response, statusCode int, body string, upstream int) {
+		t.Helper()
+		if resp.StatusCode != statusCode {
+			t.Errorf("got status %d, want %d", resp.StatusCode, statusCode)
+		}
+		if b, _ := ioutil.ReadAll(resp.Body); string(b) != body {
+			t.Errorf("got body %q, want %q", b, body)
+		}
+		if len(requests) != upstream {
+			t.Errorf("got %d upstream requests, want %d", len(requests), upstream)
+		}
+	}
+
+	status = http.StatusOK
+	header = http.Header{"Cache-Control": {"max-age=60"}, "Etag": {`"a"`}}
+	expect(get("http://respo.nd/er/abc"), http.StatusOK, "response", 1)
+
+	// fresh: served from the cache
+	now = now.Add(30 * time.Second)
+	expect(get("http://respo.nd/er/abc"), http.StatusOK, "response", 1)
+	expect(get("http://respo.nd/er/abc", "If-None-Match", `"a"`), http.StatusNotModified, "", 1)
+	// other URL
+	expect(get("http://respo.nd/er/def"), http.StatusOK, "response", 2)
+
+	// explicit revalidation
+	status = http.StatusNotModified
+	expect(get("http://respo.nd/er/abc", "Cache-Control", "no-cache"), http.StatusOK, "response", 3)
+	if inm := requests[2].Header.Get("If-None-Match"); inm != `"a"` {
+		t.Errorf("revalidation: got If-None-Match %q, want %q", inm, `"a"`)
+	}
+
+	// stale: revalidated, with refreshed freshness
+	now = now.Add(61 * time.Second)
+	expect(get("http://respo.nd/er/abc", "If-None-Match", `"b"`), http.StatusOK, "response", 4)
+	if inm := requests[3].Header.Get("If-None-Match"); inm != `"a"` {
+		t.Errorf("revalidation: got If-None-Match %q, want %q", inm, `"a"`)
+	}
+	now = now.Add(30 * time.Second)
+	expect(get("http://respo.nd/er/abc"), http.StatusOK, "response", 4)
+
+	// errors aren't cached, and don't evict the cached response
+	status = http.StatusInternalServerError
+	now = now.Add(time.Minute)
+	expect(get("http://respo.nd/er/abc"), http.StatusInternalServerError, "response", 5)
+	status = http.StatusNotModified
+	expect(get("http://respo.nd/er/abc"), http.StatusOK, "response", 6)
+
+	// stale-if-error
+	status = http.StatusOK
+	header = http.Header{"Cache-Control": {"max-age=60, stale-if-error=600"}}
+	expect(get("http://respo.nd/er/jkl"), http.StatusOK, "response", 7)
+	now = now.Add(2 * time.Minute)
+	status = http.StatusServiceUnavailable
+	resp := get("http://respo.nd/er/jkl")
+	expect(resp, http.StatusOK, "response", 8)
+	if age := resp.Header.Get("Age"); age != "120" {
+		t.Errorf("stale-if-error: got Age %q, want %q", age, "120")
+	}
+	now = now.Add(10 * time.Minute)
+	expect(get("http://respo.nd/er/jkl"), http.StatusServiceUnavailable, "response", 9)
+
+	// no-store
+	status = http.StatusOK
+	header = http.Header{"Cache-Control": {"max-age=60, no-store"}}
+	expect(get("http://respo.nd/er/ghi"), http.StatusOK, "response", 10)
+	expect(get("http://respo.nd/er/ghi"), http.StatusOK, "response", 11)
+
+	// POST
+	header = http.Header{"Cache-Control": {"max-age=60"}}
+	for i := 12; i <= 13; i++ {
+		req, _ := http.NewRequest(http.MethodPost, "http://respo.nd/er", bytes.NewReader(nil))
+		resp, err := c.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect(resp, http.StatusOK, "response", i)
+	}
+}
@@ -0,0 +1,153 @@
+package ocspd
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Keys of the attributes of the log records emitted by Fetcher and Updater.
+const (
+	// LogKeyTags is the key of the tags of a certificate, as a []string.
+	LogKeyTags = "tags"
+	// LogKeyResponder is the key of the hosts of the OCSP responders of a
+	// certificate, as used by the CircuitBreaker.
+	LogKeyResponder = "responder"
+	// LogKeyURL is the key of the URL of an OCSP responder.
+	LogKeyURL = "url"
+	// LogKeyStatus is the key of an OCSP status: good, revoked or unknown.
+	LogKeyStatus = "status"
+	// LogKeyPreviousStatus is the key of the OCSP status of the previous
+	// response, when the status changes.
+	LogKeyPreviousStatus = "previous_status"
+	// LogKeyHTTPStatus is the key of the HTTP status code of a failed fetch.
+	LogKeyHTTPStatus = "http_status"
+	// LogKeyError is the key of an error message.
+	LogKeyError = "error"
+	// LogKeyFailures is the key of a number of consecutive failures.
+	LogKeyFailures = "failures"
+	// LogKeyNextFetch is the key of the time of the next fetch.
+	LogKeyNextFetch = "next_fetch"
+	// LogKeyExpiry is the key of the time an OCSP response expires.
+	LogKeyExpiry = "expiry"
+)
+
+func errorAttr(err error) slog.Attr {
+	return slog.String(LogKeyError, err.Error())
+}
+
+var discardLogger = slog.New(discardHandler{})
+
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+// NewLogFuncHandler returns a slog.Handler that formats records of any level
+// as their message followed by their attributes, as key=value pairs, and
+// passes them to a printf-style function, such as log.Printf.
+func NewLogFuncHandler(f func(format string, v ...interface{})) slog.Handler {
+	return &logFuncHandler{f: f, mu: new(sync.Mutex)}
+}
+
+type logFuncHandler struct {
+	f      func(format string, v ...interface{})
+	mu     *sync.Mutex
+	prefix string // preformatted attributes from WithAttrs
+	group  string // group prefix for keys, ending with a dot
+}
+
+func (h *logFuncHandler) Enabled(context.Context, slog.Level) bool {
+	return true
+}
+
+func (h *logFuncHandler) Handle(_ context.Context, r slog.Record) error {
+	var b strings.Builder
+	b.WriteString(r.Message)
+	b.WriteString(h.prefix)
+	r.Attrs(func(a slog.Attr) bool {
+		appendAttr(&b, h.group, a)
+		return true
+	})
+	b.WriteString("\n")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.f("%s", b.String())
+	return nil
+}
+
+func (h *logFuncHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var b strings.Builder
+	b.WriteString(h.prefix)
+	for _, a := range attrs {
+		appendAttr(&b, h.group, a)
+	}
+	h2 := *h
+	h2.prefix = b.String()
+	return &h2
+}
+
+func (h *logFuncHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.group = h.group + name + "."
+	return &h2
+}
+
+func appendAttr(b *strings.Builder, group string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			group += a.Key + "."
+		}
+		for _, ga := range a.Value.Group() {
+			appendAttr(b, group, ga)
+		}
+		return
+	}
+	b.WriteString(" ")
+	b.WriteString(group)
+	b.WriteString(a.Key)
+	b.WriteString("=")
+	var s string
+	switch a.Value.Kind() {
+	case slog.KindTime:
+		s = a.Value.Time().Format(time.RFC3339)
+	case slog.KindAny:
+		if ss, ok := a.Value.Any().([]string); ok {
+			s = strings.Join(ss, ",")
+		} else {
+			s = fmt.Sprint(a.Value.Any())
+		}
+	default:
+		s = a.Value.String()
+	}
+	if needsQuoting(s) {
+		s = strconv.Quote(s)
+	}
+	b.WriteString(s)
+}
+
+func needsQuoting(s string) bool {
+	if s == "" {
+		return true
+	}
+	for _, r := range s {
+		if unicode.IsSpace(r) || r == '"' || r == '=' || !unicode.IsPrint(r) {
+			return true
+		}
+	}
+	return false
+}
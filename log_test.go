@@ -0,0 +1,79 @@
+package ocspd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestLogFuncHandler(t *testing.T) {
+	var logs []string
+	logger := slog.New(NewLogFuncHandler(func(format string, v ...interface{}) {
+		logs = append(logs, fmt.Sprintf(format, v...))
+	}))
+	at := time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)
+	logger.With("a", 1).WithGroup("g").Debug("message",
+		LogKeyTags, []string{"one", "two"},
+		LogKeyNextFetch, at,
+		LogKeyError, errors.New("some error"),
+		slog.Group("h", "empty", ""))
+	expected := `message a=1 g.tags=one,two g.next_fetch=2026-01-01T00:00:00Z g.error="some error" g.h.empty=""` + "\n"
+	if len(logs) != 1 || logs[0] != expected {
+		t.Errorf("got %q, want %q", logs, expected)
+	}
+}
+
+func TestUpdaterLogFunc(t *testing.T) {
+	u := &Updater{Log: func(format string, v ...interface{}) {}}
+	if l1, l2 := u.logger(), u.logger(); l1 != l2 || l1 == discardLogger {
+		t.Errorf("updater.logger: got %p then %p, want the same adapter of Log", l1, l2)
+	}
+}
+
+func TestUpdaterLogger(t *testing.T) {
+	var buf bytes.Buffer
+	u := &Updater{
+		Logger: slog.New(slog.NewJSONHandler(&buf, nil)),
+		Fetcher: &Fetcher{
+			Client: &http.Client{
+				Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+					return &http.Response{
+						StatusCode: http.StatusInternalServerError,
+						Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+					}, nil
+				}),
+			},
+		},
+	}
+	req := &Request{
+		endpoints: []endpoint{{url: "http://respo.nd/er/abc"}},
+		notAfter:  time.Now().Add(24 * time.Hour),
+	}
+	if err := u.AddOrUpdate("tag", req, nil); err != nil {
+		t.Fatal(err)
+	}
+	u.UpdateNow()
+
+	var record struct {
+		Level      string
+		Msg        string
+		Tags       []string
+		Responder  string
+		Error      string
+		HTTPStatus int `json:"http_status"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("%v: %s", err, buf.String())
+	}
+	if record.Level != "WARN" || record.Msg != "error while fetching OCSP response" ||
+		len(record.Tags) != 1 || record.Tags[0] != "tag" || record.Responder != "respo.nd" ||
+		record.Error == "" || record.HTTPStatus != http.StatusInternalServerError {
+		t.Errorf("got %+v", record)
+	}
+}
@@ -0,0 +1,41 @@
+package ocspd
+
+import "time"
+
+// Metrics receives measurements from a Fetcher or an Updater, e.g. to export
+// them to a monitoring system.
+//
+// Gauges, such as the time until the OCSP responses expire, or the number of
+// certificates by OCSP status, can be computed from Updater.Snapshot.
+//
+// Implementations must be safe for concurrent use.
+type Metrics interface {
+	// ObserveRequest is called by the Fetcher after each HTTP request to an
+	// OCSP responder, with the responder's host, the HTTP status code (zero
+	// if no HTTP response was received), the outcome (EventUpdated,
+	// EventNotModified, or EventFetchError), and the time it took, including
+	// reading and validating the response.
+	ObserveRequest(responder string, statusCode int, outcome EventType, latency time.Duration)
+	// ObserveFetch is called by the Updater after each fetch of the OCSP
+	// response of a certificate, possibly failing over several OCSP
+	// responders, with their hosts (as in log records), and the outcome
+	// (EventUpdated, EventNotModified, or EventFetchError).
+	ObserveFetch(responder string, outcome EventType)
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) ObserveRequest(string, int, EventType, time.Duration) {}
+func (nopMetrics) ObserveFetch(string, EventType)                       {}
+
+// fetchOutcome returns the outcome of a fetch, as reported to Metrics.
+func fetchOutcome(r *Response, err error) EventType {
+	switch {
+	case err != nil:
+		return EventFetchError
+	case r == nil || r.OCSPResponse == nil:
+		return EventNotModified
+	default:
+		return EventUpdated
+	}
+}
@@ -0,0 +1,66 @@
+package ocspd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingMetrics struct {
+	mu       sync.Mutex
+	requests []string
+	fetches  []string
+}
+
+func (m *recordingMetrics) ObserveRequest(responder string, statusCode int, outcome EventType, latency time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests = append(m.requests, fmt.Sprintf("%s %d %s", responder, statusCode, outcome))
+}
+
+func (m *recordingMetrics) ObserveFetch(responder string, outcome EventType) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.fetches = append(m.fetches, fmt.Sprintf("%s %s", responder, outcome))
+}
+
+func TestMetrics(t *testing.T) {
+	m := &recordingMetrics{}
+	u := &Updater{
+		Metrics: m,
+		Fetcher: &Fetcher{
+			Metrics: m,
+			Client: &http.Client{
+				Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+					if r.URL.Host == "one" {
+						return nil, fmt.Errorf("connection refused")
+					}
+					return &http.Response{
+						StatusCode: http.StatusNotModified,
+						Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+					}, nil
+				}),
+			},
+		},
+	}
+	req := &Request{
+		endpoints: []endpoint{{url: "http://one/abc"}, {url: "http://two/abc"}},
+		notAfter:  time.Now().Add(24 * time.Hour),
+	}
+	if err := u.AddOrUpdate("tag", req, nil); err != nil {
+		t.Fatal(err)
+	}
+	u.UpdateNow()
+
+	if expected := []string{"one 0 fetch error", "two 304 not modified"}; !reflect.DeepEqual(m.requests, expected) {
+		t.Errorf("Metrics.ObserveRequest: got %q, want %q", m.requests, expected)
+	}
+	if expected := []string{"one, two not modified"}; !reflect.DeepEqual(m.fetches, expected) {
+		t.Errorf("Metrics.ObserveFetch: got %q, want %q", m.fetches, expected)
+	}
+}
@@ -0,0 +1,83 @@
+package ocspd
+
+import (
+	"context"
+	"time"
+)
+
+// RateLimit configures the rate of requests sent to each OCSP responder
+// host, as a token bucket.
+type RateLimit struct {
+	// Rate is the number of requests per second sent to each OCSP responder
+	// host, on average; zero means no limit.
+	Rate float64
+	// Burst is the maximum number of requests sent to each OCSP responder
+	// host in a row, without waiting; if less than 1, 1 is used.
+	Burst int
+}
+
+func (l *RateLimit) burst() float64 {
+	if l.Burst < 1 {
+		return 1
+	}
+	return float64(l.Burst)
+}
+
+// tokenBucket limits the rate of requests to an OCSP responder host.
+type tokenBucket struct {
+	// tokens can be negative, when requests are waiting for them
+	tokens float64
+	last   time.Time
+}
+
+// reserve takes a token from the bucket, returning how long to wait before it's
+// actually available.
+func (b *tokenBucket) reserve(l *RateLimit, now time.Time) time.Duration {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * l.Rate
+		if burst := l.burst(); b.tokens > burst {
+			b.tokens = burst
+		}
+		b.last = now
+	}
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / l.Rate * float64(time.Second))
+}
+
+// wait waits for the RateLimit to allow a request to the host, or until ctx is
+// done.
+func (f *Fetcher) wait(ctx context.Context, host string) error {
+	if f == nil || f.RateLimit.Rate <= 0 {
+		return nil
+	}
+	f.mu.Lock()
+	b := f.buckets[host]
+	if b == nil {
+		b = &tokenBucket{tokens: f.RateLimit.burst(), last: f.now()}
+		if f.buckets == nil {
+			f.buckets = make(map[string]*tokenBucket)
+		}
+		f.buckets[host] = b
+	}
+	d := b.reserve(&f.RateLimit, f.now())
+	f.mu.Unlock()
+	if d <= 0 {
+		return nil
+	}
+	f.logger().Debug("rate limiting requests to OCSP responder", LogKeyResponder, host, "delay", d)
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		// give the token back
+		f.mu.Lock()
+		b.tokens++
+		f.mu.Unlock()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,75 @@
+package ocspd
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)
+	l := &RateLimit{Rate: 2, Burst: 2}
+	b := &tokenBucket{tokens: l.burst(), last: now}
+	for i, tt := range []struct {
+		elapsed  time.Duration
+		expected time.Duration
+	}{
+		{0, 0},
+		{0, 0},
+		{0, 500 * time.Millisecond},
+		{0, time.Second},
+		{time.Second, 500 * time.Millisecond},
+		{10 * time.Second, 0},
+		{0, 0},
+		{0, 500 * time.Millisecond},
+	} {
+		now = now.Add(tt.elapsed)
+		if d := b.reserve(l, now); d != tt.expected {
+			t.Errorf("reserve #%d: got %v, want %v", i, d, tt.expected)
+		}
+	}
+}
+
+func TestFetcherRateLimit(t *testing.T) {
+	var fetches int
+	f := &Fetcher{
+		RateLimit: RateLimit{Rate: 0.001},
+		Client: &http.Client{
+			Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				fetches++
+				return &http.Response{
+					StatusCode: http.StatusNotModified,
+					Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+				}, nil
+			}),
+		},
+	}
+	req := &Request{
+		endpoints: []endpoint{{url: "http://respo.nd/er/abc"}},
+		notAfter:  time.Now().Add(24 * time.Hour),
+	}
+	if _, err := f.FetchR(req, nil); err != nil {
+		t.Fatal(err)
+	}
+	// another host isn't rate limited
+	if _, err := f.FetchR(&Request{
+		endpoints: []endpoint{{url: "http://other/abc"}},
+		notAfter:  time.Now().Add(24 * time.Hour),
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := f.FetchRContext(ctx, req, nil); err != context.DeadlineExceeded {
+		t.Errorf("Fetcher.FetchRContext: got error %v, want %v", err, context.DeadlineExceeded)
+	}
+	if fetches != 2 {
+		t.Errorf("got %d fetches, want 2", fetches)
+	}
+	if tokens := f.buckets["respo.nd"].tokens; tokens < -0.01 || tokens > 0.01 {
+		t.Errorf("got %v tokens after giving the token back, want 0", tokens)
+	}
+}
@@ -0,0 +1,130 @@
+package ocspd
+
+import (
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// RefreshPolicy determines when OCSP responses need to be refreshed.
+//
+// It's used both by NeedsRefresh and by the Updater, which additionally
+// refresh responses asap when they're expired (or their delegated signer
+// certificate isn't valid yet), and never schedule refreshes more often than
+// their check period or tick round.
+type RefreshPolicy interface {
+	// NextRefresh returns the time at which the given response, last
+	// refreshed (or fetched) at lastRefresh, will need to be refreshed.
+	//
+	// The response is never expired, but the returned time can be in the
+	// past, meaning the response needs to be refreshed asap.
+	NextRefresh(resp *ocsp.Response, lastRefresh time.Time) time.Time
+}
+
+// DefaultRefreshPolicy refreshes OCSP responses halfway through their
+// validity period (which ends early if the delegated signer certificate
+// expires before NextUpdate), and then halfway through the validity period
+// remaining after each refresh.
+//
+// To spread the load on OCSP responders, the Updater schedules those
+// refreshes at a random time within the first half of the validity period
+// remaining at that point.
+var DefaultRefreshPolicy RefreshPolicy = defaultRefreshPolicy{}
+
+// spreadRefreshPolicy is implemented by refresh policies whose refreshes are
+// randomly delayed by the Updater.
+type spreadRefreshPolicy interface {
+	// spread returns the maximum delay of a refresh scheduled at next.
+	spread(resp *ocsp.Response, next time.Time) time.Duration
+}
+
+type defaultRefreshPolicy struct{}
+
+func (defaultRefreshPolicy) spread(resp *ocsp.Response, next time.Time) time.Duration {
+	if expiry := responseExpiry(resp); next.Before(expiry) {
+		return expiry.Sub(next) / 2
+	}
+	return 0
+}
+
+func (defaultRefreshPolicy) NextRefresh(resp *ocsp.Response, lastRefresh time.Time) time.Time {
+	expiry := responseExpiry(resp)
+	if h := resp.ThisUpdate.Add(expiry.Sub(resp.ThisUpdate) / 2); h.After(lastRefresh) {
+		return h
+	}
+	// already refreshed during the second half of the validity period
+	return retryRefresh(expiry, lastRefresh, 0)
+}
+
+// FractionsRefreshPolicy refreshes OCSP responses at fixed fractions of
+// their validity period (which ends early if the delegated signer certificate
+// expires before NextUpdate).
+//
+// For instance, with fractions 0.5 and 0.75, a response valid from midnight
+// to midnight the next day will be refreshed at noon then 6pm, and then every
+// RetryInterval if the OCSP responder still returns the same response.
+type FractionsRefreshPolicy struct {
+	// Fractions of the validity period, between 0 and 1, in increasing order.
+	Fractions []float64
+	// RetryInterval is the delay between refreshes once all the fractions
+	// have passed; if zero, responses are refreshed halfway through the
+	// remaining validity period.
+	RetryInterval time.Duration
+}
+
+func (p FractionsRefreshPolicy) NextRefresh(resp *ocsp.Response, lastRefresh time.Time) time.Time {
+	expiry := responseExpiry(resp)
+	validity := float64(expiry.Sub(resp.ThisUpdate))
+	for _, f := range p.Fractions {
+		if t := resp.ThisUpdate.Add(time.Duration(f * validity)); t.After(lastRefresh) {
+			return t
+		}
+	}
+	return retryRefresh(expiry, lastRefresh, p.RetryInterval)
+}
+
+// MinRemainingRefreshPolicy refreshes OCSP responses when their remaining
+// validity period (which ends early if the delegated signer certificate
+// expires before NextUpdate) falls below MinRemaining.
+type MinRemainingRefreshPolicy struct {
+	MinRemaining time.Duration
+	// RetryInterval is the delay between refreshes once the remaining
+	// validity is below MinRemaining; if zero, responses are refreshed
+	// halfway through the remaining validity period.
+	RetryInterval time.Duration
+}
+
+func (p MinRemainingRefreshPolicy) NextRefresh(resp *ocsp.Response, lastRefresh time.Time) time.Time {
+	expiry := responseExpiry(resp)
+	if t := expiry.Add(-p.MinRemaining); t.After(lastRefresh) {
+		return t
+	}
+	return retryRefresh(expiry, lastRefresh, p.RetryInterval)
+}
+
+// retryRefresh returns the time of the next refresh after lastRefresh, given
+// the retry interval (or halfway through the remaining validity period if
+// zero), never after the response expires.
+func retryRefresh(expiry, lastRefresh time.Time, interval time.Duration) time.Time {
+	if interval <= 0 {
+		return lastRefresh.Add(expiry.Sub(lastRefresh) / 2)
+	}
+	if t := lastRefresh.Add(interval); t.Before(expiry) {
+		return t
+	}
+	return expiry
+}
+
+// refreshAsap determines whether the given OCSP response needs to be
+// refreshed asap, whatever the refresh policy.
+func refreshAsap(resp *ocsp.Response, now time.Time) bool {
+	expiry := responseExpiry(resp)
+	if expiry.IsZero() || expiry.Before(now) {
+		return true
+	}
+	if resp.Certificate != nil && resp.Certificate.NotBefore.After(now) {
+		// the delegated signer certificate is not yet valid
+		return true
+	}
+	return false
+}
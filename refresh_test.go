@@ -0,0 +1,123 @@
+package ocspd
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestRefreshPolicies(t *testing.T) {
+	thisUpdate := time.Date(2016, 1, 10, 0, 0, 0, 0, time.UTC)
+	resp := &ocsp.Response{
+		Status:     ocsp.Good,
+		ThisUpdate: thisUpdate,
+		NextUpdate: thisUpdate.Add(96 * time.Hour),
+	}
+	delegated := &ocsp.Response{
+		Status:      ocsp.Good,
+		ThisUpdate:  thisUpdate,
+		NextUpdate:  thisUpdate.Add(96 * time.Hour),
+		Certificate: &x509.Certificate{NotAfter: thisUpdate.Add(48 * time.Hour)},
+	}
+
+	tests := []struct {
+		name        string
+		policy      RefreshPolicy
+		resp        *ocsp.Response
+		lastRefresh time.Duration
+		expected    time.Duration
+	}{
+		{
+			name:        "default, first half",
+			policy:      DefaultRefreshPolicy,
+			resp:        resp,
+			lastRefresh: 12 * time.Hour,
+			expected:    48 * time.Hour,
+		},
+		{
+			name:        "default, already refreshed in second half",
+			policy:      DefaultRefreshPolicy,
+			resp:        resp,
+			lastRefresh: 72 * time.Hour,
+			expected:    84 * time.Hour,
+		},
+		{
+			name:        "default, delegated signer expires before NextUpdate",
+			policy:      DefaultRefreshPolicy,
+			resp:        delegated,
+			lastRefresh: 12 * time.Hour,
+			expected:    24 * time.Hour,
+		},
+		{
+			name:        "fractions, before first",
+			policy:      FractionsRefreshPolicy{Fractions: []float64{0.5, 0.75}, RetryInterval: time.Hour},
+			resp:        resp,
+			lastRefresh: 0,
+			expected:    48 * time.Hour,
+		},
+		{
+			name:        "fractions, between fractions",
+			policy:      FractionsRefreshPolicy{Fractions: []float64{0.5, 0.75}, RetryInterval: time.Hour},
+			resp:        resp,
+			lastRefresh: 48 * time.Hour,
+			expected:    72 * time.Hour,
+		},
+		{
+			name:        "fractions, retry",
+			policy:      FractionsRefreshPolicy{Fractions: []float64{0.5, 0.75}, RetryInterval: time.Hour},
+			resp:        resp,
+			lastRefresh: 80 * time.Hour,
+			expected:    81 * time.Hour,
+		},
+		{
+			name:        "fractions, retry capped at expiry",
+			policy:      FractionsRefreshPolicy{Fractions: []float64{0.5, 0.75}, RetryInterval: time.Hour},
+			resp:        resp,
+			lastRefresh: 95*time.Hour + 30*time.Minute,
+			expected:    96 * time.Hour,
+		},
+		{
+			name:        "fractions, no retry interval",
+			policy:      FractionsRefreshPolicy{Fractions: []float64{0.5, 0.75}},
+			resp:        resp,
+			lastRefresh: 80 * time.Hour,
+			expected:    88 * time.Hour,
+		},
+		{
+			name:        "fractions, delegated signer expires before NextUpdate",
+			policy:      FractionsRefreshPolicy{Fractions: []float64{0.5, 0.75}, RetryInterval: time.Hour},
+			resp:        delegated,
+			lastRefresh: 30 * time.Hour,
+			expected:    36 * time.Hour,
+		},
+		{
+			name:        "min remaining",
+			policy:      MinRemainingRefreshPolicy{MinRemaining: 24 * time.Hour, RetryInterval: time.Hour},
+			resp:        resp,
+			lastRefresh: 0,
+			expected:    72 * time.Hour,
+		},
+		{
+			name:        "min remaining, retry",
+			policy:      MinRemainingRefreshPolicy{MinRemaining: 24 * time.Hour, RetryInterval: time.Hour},
+			resp:        resp,
+			lastRefresh: 72 * time.Hour,
+			expected:    73 * time.Hour,
+		},
+		{
+			name:        "min remaining, delegated signer expires before NextUpdate",
+			policy:      MinRemainingRefreshPolicy{MinRemaining: 24 * time.Hour, RetryInterval: time.Hour},
+			resp:        delegated,
+			lastRefresh: 0,
+			expected:    24 * time.Hour,
+		},
+	}
+	for _, test := range tests {
+		next := test.policy.NextRefresh(test.resp, thisUpdate.Add(test.lastRefresh))
+		if expected := thisUpdate.Add(test.expected); !next.Equal(expected) {
+			t.Errorf("%s: got %v, want %v", test.name, next, expected)
+		}
+	}
+}
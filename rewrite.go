@@ -0,0 +1,190 @@
+package ocspd
+
+import (
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+)
+
+// ResponderRule overrides the OCSP responder URLs of certificates, e.g. to
+// redirect them to an internal mirror or to fix a broken AIA extension.
+//
+// A rule matches if all its non-empty conditions match; a rule without
+// conditions matches everything.
+type ResponderRule struct {
+	// IssuerSubject matches the subject of the issuer, as formatted by
+	// pkix.Name.String (e.g. "CN=Example CA,O=Example,C=US").
+	IssuerSubject string `json:"issuerSubject,omitempty"`
+	// IssuerSKI matches the subject key identifier of the issuer, in
+	// hexadecimal (case-insensitive, with optional colons).
+	IssuerSKI string `json:"issuerSKI,omitempty"`
+	// Host matches the host (with optional port) of the original responder
+	// URL (case-insensitive); the rule then only applies to the matching
+	// responder URLs, and never to certificates without responder URLs.
+	Host string `json:"host,omitempty"`
+
+	// URL replaces the matching responder URLs; rules without a Host also
+	// apply to certificates without responder URLs.
+	URL string `json:"url,omitempty"`
+	// Rewrite replaces the scheme and host of the matching responder URLs,
+	// and prefixes their path with its own, e.g. with a Rewrite of
+	// "http://mirror/ca", "http://ocsp.example.com/sub" becomes
+	// "http://mirror/ca/sub".
+	Rewrite string `json:"rewrite,omitempty"`
+}
+
+// ResponderRules is a list of ResponderRule; for each responder URL, the
+// first matching rule applies.
+type ResponderRules []ResponderRule
+
+// LoadResponderRules reads the ResponderRules from a JSON file, containing an
+// array of objects with the same fields as ResponderRule (issuerSubject,
+// issuerSKI, host, url, and rewrite).
+func LoadResponderRules(filename string) (ResponderRules, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var rules ResponderRules
+	if err := json.Unmarshal(b, &rules); err != nil {
+		return nil, fmt.Errorf("ocspd: invalid responder rules in %s: %w", filename, err)
+	}
+	if err := rules.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return rules, nil
+}
+
+// Validate checks that each rule has exactly one of URL or Rewrite, and that
+// it's an absolute HTTP(S) URL.
+func (rules ResponderRules) Validate() error {
+	for i, r := range rules {
+		if (r.URL == "") == (r.Rewrite == "") {
+			return fmt.Errorf("ocspd: invalid responder rule #%d: exactly one of url or rewrite is required", i)
+		}
+		u := r.URL
+		if u == "" {
+			u = r.Rewrite
+		}
+		if err := checkResponderURL(u); err != nil {
+			return fmt.Errorf("ocspd: invalid responder rule #%d: %w", i, err)
+		}
+		if r.IssuerSKI != "" {
+			if _, err := parseSKI(r.IssuerSKI); err != nil {
+				return fmt.Errorf("ocspd: invalid responder rule #%d: invalid issuerSKI: %w", i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Apply returns the responder URLs to use for a certificate issued by issuer
+// whose responder URLs are urls (possibly none.)
+func (rules ResponderRules) Apply(urls []string, issuer *x509.Certificate) ([]string, error) {
+	if len(rules) == 0 {
+		return urls, nil
+	}
+	var result []string
+	add := func(u string) {
+		for _, r := range result {
+			if r == u {
+				return
+			}
+		}
+		result = append(result, u)
+	}
+	if len(urls) == 0 {
+		for _, r := range rules {
+			if r.Host == "" && r.URL != "" && r.matchesIssuer(issuer) {
+				add(r.URL)
+				break
+			}
+		}
+		return result, nil
+	}
+	for _, u := range urls {
+		rewritten, err := rules.apply(u, issuer)
+		if err != nil {
+			return nil, err
+		}
+		add(rewritten)
+	}
+	return result, nil
+}
+
+func (rules ResponderRules) apply(responderURL string, issuer *x509.Certificate) (string, error) {
+	for _, r := range rules {
+		if !r.matchesIssuer(issuer) {
+			continue
+		}
+		if r.Host != "" {
+			u, err := url.Parse(responderURL)
+			if err != nil {
+				return "", err
+			}
+			if !strings.EqualFold(r.Host, u.Host) && !strings.EqualFold(r.Host, u.Hostname()) {
+				continue
+			}
+		}
+		if r.URL != "" {
+			return r.URL, nil
+		}
+		return rewriteURL(responderURL, r.Rewrite)
+	}
+	return responderURL, nil
+}
+
+func (r *ResponderRule) matchesIssuer(issuer *x509.Certificate) bool {
+	if r.IssuerSubject != "" && (issuer == nil || issuer.Subject.String() != r.IssuerSubject) {
+		return false
+	}
+	if r.IssuerSKI != "" {
+		ski, err := parseSKI(r.IssuerSKI)
+		if err != nil || issuer == nil || len(issuer.SubjectKeyId) == 0 || hex.EncodeToString(issuer.SubjectKeyId) != ski {
+			return false
+		}
+	}
+	return true
+}
+
+// parseSKI normalizes a hexadecimal subject key identifier.
+func parseSKI(s string) (string, error) {
+	s = strings.ToLower(strings.Replace(s, ":", "", -1))
+	if _, err := hex.DecodeString(s); err != nil {
+		return "", err
+	}
+	return s, nil
+}
+
+func checkResponderURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("responder URL must be an absolute http or https URL: " + s)
+	}
+	return nil
+}
+
+// rewriteURL replaces the scheme and host of responderURL with the ones of
+// base, and prefixes its path with the one of base.
+func rewriteURL(responderURL, base string) (string, error) {
+	u, err := url.Parse(responderURL)
+	if err != nil {
+		return "", err
+	}
+	b, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	u.Scheme, u.Host, u.User = b.Scheme, b.Host, b.User
+	u.Path = strings.TrimSuffix(b.Path, "/") + u.Path
+	u.RawPath = ""
+	return u.String(), nil
+}
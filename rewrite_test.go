@@ -0,0 +1,142 @@
+package ocspd
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestResponderRules(t *testing.T) {
+	issuer := &x509.Certificate{
+		Subject:      pkix.Name{CommonName: "Example CA", Organization: []string{"Example"}},
+		SubjectKeyId: []byte{0xde, 0xad, 0xbe, 0xef},
+	}
+	other := &x509.Certificate{
+		Subject:      pkix.Name{CommonName: "Other CA"},
+		SubjectKeyId: []byte{0xca, 0xfe},
+	}
+	rules := ResponderRules{
+		{Host: "ocsp.example.com", Rewrite: "http://mirror.internal/example/"},
+		{IssuerSKI: "DE:AD:BE:EF", Host: "broken.example.com:8080", URL: "http://ocsp.example.com/fixed"},
+		{IssuerSubject: "CN=Example CA,O=Example", URL: "http://mirror.internal/default"},
+	}
+	if err := rules.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for i, tt := range []struct {
+		urls     []string
+		issuer   *x509.Certificate
+		expected []string
+	}{
+		{[]string{"http://ocsp.example.com/sub?q"}, other, []string{"http://mirror.internal/example/sub?q"}},
+		{[]string{"http://OCSP.example.com"}, other, []string{"http://mirror.internal/example"}},
+		{[]string{"http://broken.example.com:8080/"}, issuer, []string{"http://ocsp.example.com/fixed"}},
+		{[]string{"http://broken.example.com:8080/"}, other, []string{"http://broken.example.com:8080/"}},
+		{[]string{"http://ocsp.other.com/", "http://broken.example.com:8080/"}, issuer, []string{"http://mirror.internal/default", "http://ocsp.example.com/fixed"}},
+		{[]string{"http://ocsp.other.com/", "http://ocsp.other.org/"}, issuer, []string{"http://mirror.internal/default"}},
+		// certificates without responder URLs
+		{nil, issuer, []string{"http://mirror.internal/default"}},
+		{nil, other, nil},
+	} {
+		urls, err := rules.Apply(tt.urls, tt.issuer)
+		if err != nil {
+			t.Errorf("rules.Apply #%d: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(urls, tt.expected) {
+			t.Errorf("rules.Apply #%d: got %v, want %v", i, urls, tt.expected)
+		}
+	}
+
+	for i, invalid := range []ResponderRules{
+		{{Host: "ocsp.example.com"}},
+		{{URL: "http://a/", Rewrite: "http://b/"}},
+		{{URL: "ldap://a/"}},
+		{{Rewrite: "/relative"}},
+		{{IssuerSKI: "not hex", URL: "http://a/"}},
+	} {
+		if err := invalid.Validate(); err == nil {
+			t.Errorf("rules.Validate #%d: expected an error", i)
+		}
+	}
+}
+
+func TestLoadResponderRules(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "rules.json")
+	if err := ioutil.WriteFile(filename, []byte(`[
+		{"issuerSKI": "deadbeef", "url": "http://mirror.internal/"},
+		{"host": "ocsp.example.com", "rewrite": "https://ocsp.example.com"}
+	]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := LoadResponderRules(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := ResponderRules{
+		{IssuerSKI: "deadbeef", URL: "http://mirror.internal/"},
+		{Host: "ocsp.example.com", Rewrite: "https://ocsp.example.com"},
+	}
+	if !reflect.DeepEqual(rules, expected) {
+		t.Errorf("LoadResponderRules: got %v, want %v", rules, expected)
+	}
+
+	if err := ioutil.WriteFile(filename, []byte(`[{"host": "ocsp.example.com"}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadResponderRules(filename); err == nil {
+		t.Error("LoadResponderRules: expected an error")
+	}
+}
+
+func TestCreateRequestWithResponderRules(t *testing.T) {
+	leafCert, _ := hex.DecodeString(leafCertHex)
+	cert, err := x509.ParseCertificate(leafCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuerCert, _ := hex.DecodeString(issuerCertHex)
+	issuer, err := x509.ParseCertificate(issuerCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert.OCSPServer = []string{"http://one/"}
+	opts := &RequestOptions{ResponderRules: ResponderRules{{Host: "one", Rewrite: "http://mirror/one"}}}
+	request, err := CreateRequestWithOptions(cert, issuer, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(request.endpoints) != 1 || request.endpoints[0].url != "http://mirror/one/"+ocspRequestBase64 {
+		t.Errorf("request.endpoints: got %v, want [http://mirror/one/%s]", request.endpoints, ocspRequestBase64)
+	}
+
+	// ResponderURL takes precedence
+	opts.ResponderURL = "http://override/"
+	if request, err = CreateRequestWithOptions(cert, issuer, opts); err != nil {
+		t.Fatal(err)
+	}
+	if len(request.endpoints) != 1 || request.endpoints[0].url != "http://override/"+ocspRequestBase64 {
+		t.Errorf("request.endpoints: got %v, want [http://override/%s]", request.endpoints, ocspRequestBase64)
+	}
+
+	// certificates without responder URLs
+	cert.OCSPServer = nil
+	opts = &RequestOptions{ResponderRules: ResponderRules{{IssuerSubject: issuer.Subject.String(), URL: "http://mirror/"}}}
+	if request, err = CreateRequestWithOptions(cert, issuer, opts); err != nil {
+		t.Fatal(err)
+	}
+	if len(request.endpoints) != 1 || request.endpoints[0].url != "http://mirror/"+ocspRequestBase64 {
+		t.Errorf("request.endpoints: got %v, want [http://mirror/%s]", request.endpoints, ocspRequestBase64)
+	}
+
+	opts.ResponderRules[0].URL = "mirror"
+	if _, err = CreateRequestWithOptions(cert, issuer, opts); err == nil {
+		t.Error("CreateRequestWithOptions: expected an error with invalid rules")
+	}
+}
@@ -0,0 +1,121 @@
+package ocspd
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ShutdownError is returned by Shutdown when in-flight fetches or callbacks
+// didn't finish in time.
+type ShutdownError struct {
+	// Err is the error of the context passed to Shutdown.
+	Err error
+	// Tags are the tags of the monitored certificates whose in-flight
+	// fetches have been aborted.
+	Tags []string
+	// Callbacks is the number of OnUpdate, OnEvent and OnRevoked calls that
+	// were still running or waiting for a previous one to return.
+	Callbacks int
+}
+
+func (e *ShutdownError) Error() string {
+	return fmt.Sprintf("ocspd: shutdown: %s; aborted fetches for [%s]; %d callback(s) still running", e.Err.Error(), strings.Join(e.Tags, ", "), e.Callbacks)
+}
+
+func (e *ShutdownError) Unwrap() error {
+	return e.Err
+}
+
+// Shutdown gracefully stops the Updater: it stops scheduling fetches (Run
+// then returns ErrUpdaterShutdown, and UpdateNow does nothing), and waits for
+// the in-flight fetches and the OnUpdate (or DeliverUpdate), OnEvent and
+// OnRevoked calls to finish. Failed deliveries aren't retried anymore.
+//
+// If ctx is done before then, the in-flight fetches are aborted and Shutdown
+// returns a *ShutdownError reporting what was cut short; the callbacks can't
+// be aborted though.
+//
+// Once shut down, an Updater can't be restarted.
+func (u *Updater) Shutdown(ctx context.Context) error {
+	u.mu.Lock()
+	if !u.shutDown {
+		u.shutDown = true
+		shutdown, _ := u.shutdownChans()
+		close(shutdown)
+		u.resetTimer()
+	}
+	u.mu.Unlock()
+
+	for {
+		u.mu.Lock()
+		idle := u.idleChan()
+		if idle == nil {
+			u.stopDeliveries()
+			u.mu.Unlock()
+			u.flushState()
+			return nil
+		}
+		u.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			err := u.abortShutdown(ctx.Err())
+			u.flushState()
+			return err
+		case <-idle:
+		}
+	}
+}
+
+// idleChan returns a channel closed once there are no in-flight fetches nor
+// running callbacks, or nil if there are none already.
+func (u *Updater) idleChan() <-chan struct{} {
+	if u.fetches == 0 && u.callbacks == 0 {
+		return nil
+	}
+	if u.idle == nil {
+		u.idle = make(chan struct{})
+	}
+	return u.idle
+}
+
+// checkIdle closes the channel returned by idleChan, if any, once there are
+// no in-flight fetches nor running callbacks.
+func (u *Updater) checkIdle() {
+	if u.idle != nil && u.fetches == 0 && u.callbacks == 0 {
+		close(u.idle)
+		u.idle = nil
+	}
+}
+
+// abortShutdown aborts the in-flight fetches.
+func (u *Updater) abortShutdown(err error) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.stopDeliveries()
+	if u.fetches == 0 && u.callbacks == 0 {
+		return nil
+	}
+	e := &ShutdownError{Err: err, Callbacks: u.callbacks}
+	for _, s := range u.statuses {
+		if s.fetching {
+			e.Tags = append(e.Tags, s.Tags...)
+		}
+	}
+	sort.Strings(e.Tags)
+	if !u.aborted {
+		u.aborted = true
+		_, abort := u.shutdownChans()
+		close(abort)
+	}
+	return e
+}
+
+func (u *Updater) shutdownChans() (shutdown, abort chan struct{}) {
+	if u.shutdown == nil {
+		u.shutdown = make(chan struct{})
+		u.abort = make(chan struct{})
+	}
+	return u.shutdown, u.abort
+}
@@ -0,0 +1,118 @@
+package ocspd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestUpdaterShutdown(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	callbackRelease := make(chan struct{})
+	var fetches int
+	u := &Updater{
+		OnEvent: func(ev Event) { <-callbackRelease },
+		Fetcher: &Fetcher{
+			Client: &http.Client{
+				Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+					fetches++
+					started <- struct{}{}
+					<-release
+					return &http.Response{
+						StatusCode: http.StatusInternalServerError,
+						Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+					}, nil
+				}),
+			},
+		},
+	}
+	req := &Request{
+		endpoints: []endpoint{{url: "http://respo.nd/er/abc"}},
+		notAfter:  time.Now().Add(24 * time.Hour),
+	}
+	if err := u.AddOrUpdate("tag", req, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	runErr := make(chan error, 1)
+	go func() { runErr <- u.Run(context.Background()) }()
+	<-started
+
+	shutdownErr := make(chan error, 1)
+	go func() { shutdownErr <- u.Shutdown(context.Background()) }()
+	select {
+	case err := <-shutdownErr:
+		t.Fatalf("updater.Shutdown: returned %v before the fetch finished", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case err := <-shutdownErr:
+		t.Fatalf("updater.Shutdown: returned %v before the callback finished", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(callbackRelease)
+	if err := <-shutdownErr; err != nil {
+		t.Errorf("updater.Shutdown: got error %v", err)
+	}
+	if err := <-runErr; err != ErrUpdaterShutdown {
+		t.Errorf("updater.Run: got %v, want %v", err, ErrUpdaterShutdown)
+	}
+
+	u.UpdateNow()
+	if err := u.Run(context.Background()); err != ErrUpdaterShutdown {
+		t.Errorf("updater.Run: got %v after shutdown, want %v", err, ErrUpdaterShutdown)
+	}
+	if fetches != 1 {
+		t.Errorf("got %d fetches, want 1", fetches)
+	}
+}
+
+func TestUpdaterShutdownDeadline(t *testing.T) {
+	started := make(chan struct{}, 1)
+	u := &Updater{
+		Fetcher: &Fetcher{
+			Client: &http.Client{
+				Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+					started <- struct{}{}
+					<-r.Context().Done()
+					return nil, r.Context().Err()
+				}),
+			},
+		},
+	}
+	req := &Request{
+		endpoints: []endpoint{{url: "http://respo.nd/er/abc"}},
+		notAfter:  time.Now().Add(24 * time.Hour),
+	}
+	if err := u.AddOrUpdate("tag", req, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	runErr := make(chan error, 1)
+	go func() { runErr <- u.Run(context.Background()) }()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := u.Shutdown(ctx)
+	var se *ShutdownError
+	if !errors.As(err, &se) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("updater.Shutdown: got %v, want a ShutdownError", err)
+	}
+	if !reflect.DeepEqual(se.Tags, []string{"tag"}) || se.Callbacks != 0 {
+		t.Errorf("updater.Shutdown: got %+v", se)
+	}
+	if err := <-runErr; err != ErrUpdaterShutdown {
+		t.Errorf("updater.Run: got %v, want %v", err, ErrUpdaterShutdown)
+	}
+	if s := u.tagToStatus["tag"]; s.fetching || s.failures != 0 {
+		t.Errorf("updater.Shutdown: got status %+v after aborting the fetch", s)
+	}
+}
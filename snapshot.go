@@ -0,0 +1,77 @@
+package ocspd
+
+import (
+	"sort"
+	"time"
+)
+
+// TagStatus describes the state of a tag monitored by an Updater, see
+// Updater.Snapshot.
+type TagStatus struct {
+	Tag string
+	// The OCSP responder that will be queried first (the one that last worked)
+	ResponderURL string
+
+	// Whether an OCSP response is available; if false, the Status,
+	// ThisUpdate and NextUpdate are meaningless.
+	HasResponse bool
+	// The certificate status: ocsp.Good, ocsp.Revoked, or ocsp.Unknown
+	Status     int
+	ThisUpdate time.Time
+	NextUpdate time.Time
+	// The ETag of the last OCSP response, if any
+	ETag string
+
+	// The time of the next scheduled fetch (zero if asap)
+	NextFetch time.Time
+	// The time of the last fetch, or zero if none yet
+	LastFetch time.Time
+	// The outcome of the last fetch: EventUpdated, EventNotModified, or
+	// EventFetchError; meaningless if LastFetch is zero.
+	LastOutcome EventType
+	// The error of the last fetch, if it failed
+	LastError error
+	// The number of consecutive failed fetches
+	Failures int
+
+	// The time the certificate (or its issuer, if earlier) expires
+	CertNotAfter time.Time
+	// Whether the certificate is expired, and its OCSP response no longer
+	// refreshed
+	CertExpired bool
+}
+
+// Snapshot returns the current state of all monitored tags, sorted by tag.
+func (u *Updater) Snapshot() []TagStatus {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	snapshot := make([]TagStatus, 0, len(u.tagToStatus))
+	for tag, s := range u.tagToStatus {
+		ts := TagStatus{
+			Tag:         tag,
+			NextFetch:   s.NextUpdate,
+			LastFetch:   s.lastFetch,
+			LastOutcome: s.lastOutcome,
+			LastError:   s.lastErr,
+			Failures:    s.failures,
+
+			CertNotAfter: s.Request.notAfter,
+			CertExpired:  s.expired,
+		}
+		if len(s.Request.endpoints) > 0 {
+			ts.ResponderURL = s.Request.endpoints[s.Request.preferredEndpoint()].responderURL
+		}
+		if s.Response != nil {
+			ts.ETag = s.Response.Etag
+			if resp := s.Response.OCSPResponse; resp != nil {
+				ts.HasResponse = true
+				ts.Status = resp.Status
+				ts.ThisUpdate, ts.NextUpdate = resp.ThisUpdate, resp.NextUpdate
+			}
+		}
+		snapshot = append(snapshot, ts)
+	}
+	sort.Slice(snapshot, func(i, j int) bool { return snapshot[i].Tag < snapshot[j].Tag })
+	return snapshot
+}
@@ -0,0 +1,95 @@
+package ocspd
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestUpdaterSnapshot(t *testing.T) {
+	now := time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)
+	u := &Updater{
+		Backoff: Backoff{Initial: time.Minute},
+		Fetcher: &Fetcher{
+			Client: &http.Client{
+				Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+					return &http.Response{
+						StatusCode: http.StatusInternalServerError,
+						Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+					}, nil
+				}),
+			},
+			time: func() time.Time { return now },
+		},
+	}
+	cached := &Response{
+		OCSPResponse: &ocsp.Response{
+			Status:     ocsp.Good,
+			ThisUpdate: now.Add(-time.Hour),
+			NextUpdate: now.Add(time.Hour),
+		},
+		Etag:   `"etag"`,
+		MaxAge: now.Add(10 * time.Minute),
+	}
+	leafCert, _ := hex.DecodeString(leafCertHex)
+	cert, err := x509.ParseCertificate(leafCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuerCert, _ := hex.DecodeString(issuerCertHex)
+	issuer, err := x509.ParseCertificate(issuerCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	createRequest := func(responderURLs ...string) *Request {
+		cert.OCSPServer = responderURLs
+		req, err := CreateRequest(cert, issuer, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.notAfter = now.Add(24 * time.Hour)
+		return req
+	}
+
+	req := createRequest("http://one/", "http://two")
+	req.setPreferredEndpoint(1)
+	if err := u.AddOrUpdate("cached", req, cached); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.AddOrUpdate("failing", createRequest("http://respo.nd/er"), nil); err != nil {
+		t.Fatal(err)
+	}
+	u.UpdateNow()
+
+	snapshot := u.Snapshot()
+	if len(snapshot) != 2 {
+		t.Fatalf("updater.Snapshot: got %d tags, want 2", len(snapshot))
+	}
+	expected := TagStatus{
+		Tag:          "cached",
+		ResponderURL: "http://two",
+		HasResponse:  true,
+		Status:       ocsp.Good,
+		ThisUpdate:   now.Add(-time.Hour),
+		NextUpdate:   now.Add(time.Hour),
+		ETag:         `"etag"`,
+		NextFetch:    now.Add(10 * time.Minute),
+		CertNotAfter: now.Add(24 * time.Hour),
+	}
+	if !reflect.DeepEqual(snapshot[0], expected) {
+		t.Errorf("updater.Snapshot: got %+v, want %+v", snapshot[0], expected)
+	}
+	failing := snapshot[1]
+	if failing.Tag != "failing" || failing.ResponderURL != "http://respo.nd/er" || failing.HasResponse ||
+		!failing.NextFetch.Equal(now.Add(time.Minute)) || !failing.LastFetch.Equal(now) ||
+		failing.LastOutcome != EventFetchError || failing.LastError == nil || failing.Failures != 1 {
+		t.Errorf("updater.Snapshot: got %+v for failing tag", failing)
+	}
+}
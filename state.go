@@ -0,0 +1,204 @@
+package ocspd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+const stateVersion = 1
+
+// state is the content of the Updater's StateFile.
+type state struct {
+	Version int `json:"version"`
+	// Requests are keyed by a hash of the OCSP request.
+	Requests map[string]savedStatus `json:"requests"`
+}
+
+// savedStatus is the persisted scheduling state of an ocspStatus.
+type savedStatus struct {
+	// Tags are only informative.
+	Tags []string `json:"tags,omitempty"`
+	// ThisUpdate of the cached OCSP response the state applies to; zero if
+	// there was no cached response.
+	ThisUpdate   time.Time `json:"thisUpdate"`
+	Etag         string    `json:"etag,omitempty"`
+	LastModified time.Time `json:"lastModified"`
+	MaxAge       time.Time `json:"maxAge"`
+	// StaleWhileRevalidate and StaleIfError extend MaxAge, see Response.
+	StaleWhileRevalidate time.Time `json:"staleWhileRevalidate"`
+	StaleIfError         time.Time `json:"staleIfError"`
+	NextFetch            time.Time `json:"nextFetch"`
+	LastFetch            time.Time `json:"lastFetch"`
+	Failures             int       `json:"failures,omitempty"`
+	Deferred             bool      `json:"deferred,omitempty"`
+	CertExpired          bool      `json:"certExpired,omitempty"`
+}
+
+// stateKey returns the key of the OCSP request in the state file.
+func stateKey(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
+
+// LoadState reads the scheduling state from the StateFile, if any.
+//
+// The saved state of a certificate is restored only if it was saved for the
+// same OCSP request and cached OCSP response (as determined by its
+// ThisUpdate): it then replaces the ETag, LastModified and freshness (MaxAge,
+// StaleWhileRevalidate and StaleIfError) of the cached response, the number of
+// consecutive failures, and the time of the next fetch. The state of
+// certificates that aren't monitored yet is restored when they're added with
+// AddOrUpdate.
+//
+// LoadState returns an error satisfying os.IsNotExist if the StateFile
+// doesn't exist.
+func (u *Updater) LoadState() error {
+	if u.StateFile == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(u.StateFile)
+	if err != nil {
+		return err
+	}
+	var st state
+	if err := json.Unmarshal(b, &st); err != nil {
+		return fmt.Errorf("ocspd: invalid state file %s: %w", u.StateFile, err)
+	}
+	if st.Version != stateVersion {
+		return fmt.Errorf("ocspd: unsupported state file version %d", st.Version)
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.saved = st.Requests
+	for _, s := range u.statuses {
+		if !s.fetching && u.restoreStatus(s) {
+			u.spreadStartup(s)
+		}
+	}
+	u.resetTimer()
+	return nil
+}
+
+// restoreStatus applies the saved state for s, if any and if it was saved
+// for the same cached OCSP response; it returns whether it did.
+func (u *Updater) restoreStatus(s *ocspStatus) bool {
+	k := stateKey(s.key)
+	ss, ok := u.saved[k]
+	if !ok {
+		return false
+	}
+	delete(u.saved, k)
+	if s.Response == nil || s.Response.OCSPResponse == nil {
+		if !ss.ThisUpdate.IsZero() {
+			return false
+		}
+	} else {
+		if !ss.ThisUpdate.Equal(s.Response.OCSPResponse.ThisUpdate) {
+			return false
+		}
+		// don't modify the caller's response
+		r := *s.Response
+		r.Etag, r.LastModified, r.MaxAge = ss.Etag, ss.LastModified, ss.MaxAge
+		r.StaleWhileRevalidate, r.StaleIfError = ss.StaleWhileRevalidate, ss.StaleIfError
+		s.Response = &r
+	}
+	s.NextUpdate = ss.NextFetch
+	s.lastFetch = ss.LastFetch
+	s.failures = ss.Failures
+	s.deferred = ss.Deferred
+	s.expired = ss.CertExpired
+	u.fix(s)
+	return true
+}
+
+// stateSaveDelay is how long the state is saved after a fetch made by Run,
+// so that a single write covers the fetches finishing in the mean time.
+const stateSaveDelay = 10 * time.Second
+
+// SaveState atomically writes the scheduling state of all the monitored
+// certificates to the StateFile, if any.
+//
+// SaveState is automatically called after each UpdateNow, shortly after the
+// fetches made by Run, and by Shutdown.
+func (u *Updater) SaveState() error {
+	return u.writeState(false)
+}
+
+// scheduleSave saves the state after stateSaveDelay, unless already
+// scheduled.
+func (u *Updater) scheduleSave() {
+	if u.StateFile == "" || u.savePending {
+		return
+	}
+	u.savePending = true
+	time.AfterFunc(stateSaveDelay, u.flushState)
+}
+
+// flushState saves the state if it changed since it was last saved, logging
+// errors.
+func (u *Updater) flushState() {
+	if err := u.writeState(true); err != nil {
+		u.logger().Error("error while saving state", "file", u.StateFile, errorAttr(err))
+	}
+}
+
+// writeState writes the state to the StateFile; if pendingOnly, only if it
+// changed since it was last written.
+//
+// The Updater is only locked while copying the state.
+func (u *Updater) writeState(pendingOnly bool) error {
+	// an older state must never replace a newer one
+	u.saveMu.Lock()
+	defer u.saveMu.Unlock()
+
+	type keyedStatus struct {
+		key string
+		savedStatus
+	}
+	u.mu.Lock()
+	if u.StateFile == "" || (pendingOnly && !u.savePending) {
+		u.mu.Unlock()
+		return nil
+	}
+	u.savePending = false
+	filename := u.StateFile
+	statuses := make([]keyedStatus, 0, len(u.statuses))
+	for _, s := range u.statuses {
+		ss := savedStatus{
+			Tags:        append([]string(nil), s.Tags...),
+			NextFetch:   s.NextUpdate,
+			LastFetch:   s.lastFetch,
+			Failures:    s.failures,
+			Deferred:    s.deferred,
+			CertExpired: s.expired,
+		}
+		if s.Response != nil && s.Response.OCSPResponse != nil {
+			ss.ThisUpdate = s.Response.OCSPResponse.ThisUpdate
+			ss.Etag = s.Response.Etag
+			ss.LastModified = s.Response.LastModified
+			ss.MaxAge = s.Response.MaxAge
+			ss.StaleWhileRevalidate = s.Response.StaleWhileRevalidate
+			ss.StaleIfError = s.Response.StaleIfError
+		}
+		statuses = append(statuses, keyedStatus{s.key, ss})
+	}
+	u.mu.Unlock()
+
+	st := state{
+		Version:  stateVersion,
+		Requests: make(map[string]savedStatus, len(statuses)),
+	}
+	for _, s := range statuses {
+		st.Requests[stateKey(s.key)] = s.savedStatus
+	}
+	b, err := json.Marshal(&st)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(filename, b, 0600)
+}
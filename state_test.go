@@ -0,0 +1,235 @@
+package ocspd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestUpdaterState(t *testing.T) {
+	now := time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)
+	thisUpdate := now.Add(-time.Hour)
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	newUpdater := func() *Updater {
+		return &Updater{
+			StateFile: stateFile,
+			Backoff:   Backoff{Initial: time.Minute},
+			Fetcher: &Fetcher{
+				Client: &http.Client{
+					Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+						return &http.Response{
+							StatusCode: http.StatusInternalServerError,
+							Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+						}, nil
+					}),
+				},
+				time: func() time.Time { return now },
+			},
+		}
+	}
+	cachedRequest := func() *Request {
+		return &Request{
+			endpoints: []endpoint{{url: "http://respo.nd/er/cached"}},
+			notAfter:  now.Add(24 * time.Hour),
+		}
+	}
+	failingRequest := func() *Request {
+		return &Request{
+			endpoints: []endpoint{{url: "http://respo.nd/er/failing"}},
+			notAfter:  now.Add(24 * time.Hour),
+		}
+	}
+	cached := func(thisUpdate time.Time) *Response {
+		return &Response{
+			OCSPResponse: &ocsp.Response{
+				Status:     ocsp.Good,
+				ThisUpdate: thisUpdate,
+				NextUpdate: thisUpdate.Add(2 * time.Hour),
+			},
+			LastModified: thisUpdate,
+		}
+	}
+
+	u := newUpdater()
+	if err := u.LoadState(); !os.IsNotExist(err) {
+		t.Fatalf("updater.LoadState: got %v, want not exist error", err)
+	}
+	resp := cached(thisUpdate)
+	resp.Etag = `"etag"`
+	resp.MaxAge = now.Add(10 * time.Minute)
+	if err := u.AddOrUpdate("cached", cachedRequest(), resp); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.AddOrUpdate("failing", failingRequest(), nil); err != nil {
+		t.Fatal(err)
+	}
+	u.UpdateNow()
+	u.UpdateNow() // no-op, nothing's due
+	now = now.Add(time.Minute)
+	u.UpdateNow()
+	saved := u.Snapshot()
+
+	// restart, with the state loaded both before and after adding certificates
+	u = newUpdater()
+	if err := u.AddOrUpdate("failing", failingRequest(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.LoadState(); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.AddOrUpdate("cached", cachedRequest(), cached(thisUpdate)); err != nil {
+		t.Fatal(err)
+	}
+	restored := u.Snapshot()
+	for i := range saved {
+		s, r := saved[i], restored[i]
+		if r.ETag != s.ETag || !r.NextFetch.Equal(s.NextFetch) || !r.LastFetch.Equal(s.LastFetch) || r.Failures != s.Failures {
+			t.Errorf("updater.LoadState: got %+v, want %+v", r, s)
+		}
+	}
+	if restored[0].ETag != `"etag"` || !restored[0].NextFetch.Equal(now.Add(9*time.Minute)) {
+		t.Errorf("updater.LoadState: got %+v for cached tag", restored[0])
+	}
+	if restored[1].Failures != 2 || !restored[1].NextFetch.Equal(now.Add(2*time.Minute)) {
+		t.Errorf("updater.LoadState: got %+v for failing tag", restored[1])
+	}
+
+	// the state isn't restored for a different cached response
+	u = newUpdater()
+	if err := u.LoadState(); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.AddOrUpdate("cached", cachedRequest(), cached(thisUpdate.Add(time.Minute))); err != nil {
+		t.Fatal(err)
+	}
+	if s := u.Snapshot()[0]; s.ETag != "" || !s.LastFetch.IsZero() {
+		t.Errorf("updater.LoadState: restored state for a different response: %+v", s)
+	}
+}
+
+func TestUpdaterStateRun(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	fetched := make(chan struct{}, 1)
+	u := &Updater{
+		StateFile: stateFile,
+		Fetcher: &Fetcher{
+			Client: &http.Client{
+				Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+					return &http.Response{
+						StatusCode: http.StatusInternalServerError,
+						Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+					}, nil
+				}),
+			},
+		},
+		OnEvent: func(ev Event) {
+			if ev.Type == EventFetchError {
+				select {
+				case fetched <- struct{}{}:
+				default:
+				}
+			}
+		},
+	}
+	if err := u.AddOrUpdate("failing", &Request{
+		endpoints: []endpoint{{url: "http://respo.nd/er/failing"}},
+		notAfter:  time.Now().Add(24 * time.Hour),
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- u.Run(context.Background())
+	}()
+	select {
+	case <-fetched:
+	case <-time.After(5 * time.Second):
+		t.Fatal("updater.Run: fetch not started")
+	}
+	// the state is saved later, or on shutdown
+	if _, err := os.Stat(stateFile); !os.IsNotExist(err) {
+		t.Errorf("updater.Run: state saved right after the fetch: %v", err)
+	}
+	if err := u.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	u2 := &Updater{StateFile: stateFile, Fetcher: u.Fetcher}
+	if err := u2.AddOrUpdate("failing", &Request{
+		endpoints: []endpoint{{url: "http://respo.nd/er/failing"}},
+		notAfter:  time.Now().Add(24 * time.Hour),
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := u2.LoadState(); err != nil {
+		t.Fatal(err)
+	}
+	if s := u2.Snapshot()[0]; s.Failures != 1 {
+		t.Errorf("updater.Shutdown: got %+v, want state saved after 1 failure", s)
+	}
+}
+
+func TestUpdaterStateStartupSpread(t *testing.T) {
+	now := time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	newRequest := func(tag string) *Request {
+		return &Request{
+			endpoints: []endpoint{{url: "http://respo.nd/er/" + tag}},
+			notAfter:  now.Add(24 * time.Hour),
+		}
+	}
+	newResponse := func() *Response {
+		// due after the window, but saved as due within it
+		return &Response{OCSPResponse: &ocsp.Response{ThisUpdate: now.Add(-24 * time.Hour), NextUpdate: now.Add(72 * time.Hour)}}
+	}
+	st := state{Version: stateVersion, Requests: make(map[string]savedStatus)}
+	for _, tag := range []string{"added", "loaded"} {
+		st.Requests[stateKey(requestKey(newRequest(tag)))] = savedStatus{
+			ThisUpdate: now.Add(-24 * time.Hour),
+			NextFetch:  now.Add(10 * time.Minute),
+		}
+	}
+	b, err := json.Marshal(&st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(stateFile, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	u := &Updater{
+		StateFile:     stateFile,
+		StartupSpread: time.Hour,
+		TickRound:     time.Nanosecond,
+		RefreshPolicy: MinRemainingRefreshPolicy{MinRemaining: 48 * time.Hour, RetryInterval: time.Minute},
+		Fetcher:       &Fetcher{time: func() time.Time { return now }},
+		rand:          func(d time.Duration) time.Duration { return d / 2 },
+	}
+	// the state is loaded both before and after adding certificates
+	if err := u.AddOrUpdate("loaded", newRequest("loaded"), newResponse()); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.LoadState(); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.AddOrUpdate("added", newRequest("added"), newResponse()); err != nil {
+		t.Fatal(err)
+	}
+	// spread from the saved next fetch until the end of the window
+	expected := now.Add(10*time.Minute + 25*time.Minute)
+	for _, tag := range []string{"added", "loaded"} {
+		if s := u.tagToStatus[tag]; !s.NextUpdate.Equal(expected) {
+			t.Errorf("updater.LoadState (%s): next update at %v, want %v", tag, s.NextUpdate, expected)
+		}
+	}
+}
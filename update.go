@@ -2,10 +2,10 @@ package ocspd
 
 import (
 	"crypto/x509"
-	"errors"
 	"io/ioutil"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -28,55 +28,82 @@ func Update(cert, issuer *x509.Certificate, responderURL string) ([]byte, error)
 }
 
 // ResponderURL extracts the OCSP responder URL from the given certificate.
+//
+// It returns the first HTTP(S) URL, see ResponderURLs.
 func ResponderURL(cert *x509.Certificate) (string, error) {
+	urls, err := ResponderURLs(cert)
+	if err != nil {
+		return "", err
+	}
+	if len(urls) == 0 {
+		return "", errNoResponderURL
+	}
+	return urls[0], nil
+}
+
+// ResponderURLs extracts all the HTTP(S) OCSP responder URLs from the given
+// certificate, in order. It returns an empty list if there's none.
+func ResponderURLs(cert *x509.Certificate) ([]string, error) {
+	var urls []string
 	for _, ocspServer := range cert.OCSPServer {
-		if !strings.EqualFold(ocspServer[0:7], "http://") && !strings.EqualFold(ocspServer[0:8], "https://") {
+		if !hasPrefixFold(ocspServer, "http://") && !hasPrefixFold(ocspServer, "https://") {
 			continue
 		}
 		if _, err := url.Parse(ocspServer); err != nil {
-			return "", err
+			return nil, err
 		}
-		return ocspServer, nil
+		urls = append(urls, ocspServer)
 	}
-	return "", errors.New("Cannot find an OCSP URL")
+	return urls, nil
 }
 
-// NeedsRefresh determines whether the given OCSP response needs to be refreshed.
+func hasPrefixFold(s, prefix string) bool {
+	return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+}
+
+// NeedsRefresh determines whether the given OCSP response needs to be refreshed,
+// according to DefaultRefreshPolicy.
 //
-// If the response has no NextUpdate information, it needs to be refreshed.
-// Otherwise, it'll need to be refreshed halfway through its validity period,
-// and to avoid refreshing too many times during that interval the last refresh
-// time and the checks period are used as guidance.
+// See NeedsRefreshWithPolicy.
 func NeedsRefresh(resp *ocsp.Response, mtime time.Time, period time.Duration) bool {
-	return needsRefresh(resp, mtime, period, time.Now())
+	return NeedsRefreshWithPolicy(resp, mtime, period, nil)
+}
+
+// NeedsRefreshWithPolicy determines whether the given OCSP response needs to
+// be refreshed, according to the given policy (or DefaultRefreshPolicy if nil).
+//
+// If the response has no NextUpdate information, or is expired, it needs to be
+// refreshed. Otherwise, it needs to be refreshed if the policy says so given
+// the last refresh time (mtime), or if the response will be expired when it's
+// next checked, after the checks period.
+func NeedsRefreshWithPolicy(resp *ocsp.Response, mtime time.Time, period time.Duration, policy RefreshPolicy) bool {
+	return needsRefresh(resp, mtime, period, policy, time.Now())
 }
 
-func needsRefresh(resp *ocsp.Response, mtime time.Time, period time.Duration, now time.Time) bool {
-	// TODO: take into account the signer certificate's NotAfter and NotBefore
-	if resp.NextUpdate.IsZero() || resp.NextUpdate.Before(now) {
+func needsRefresh(resp *ocsp.Response, mtime time.Time, period time.Duration, policy RefreshPolicy, now time.Time) bool {
+	if refreshAsap(resp, now) {
 		return true
 	}
-	if now.Add(period).After(resp.NextUpdate) {
+	if now.Add(period).After(responseExpiry(resp)) {
 		// next time we'll check the response will be expired
 		return true
 	}
-	h := resp.ThisUpdate.Add(resp.NextUpdate.Sub(resp.ThisUpdate) / 2)
-	if h.After(now) {
-		// still in the first half of the validity period
-		return false
-	}
-	if h.After(mtime) {
-		// this is the first time we check during the second half of the validity period
-		return true
+	if policy == nil {
+		policy = DefaultRefreshPolicy
 	}
-	// TODO: refresh more often during the second half of the validity period
-	return false
+	return !policy.NextRefresh(resp, mtime).After(now)
 }
 
 // NeedsRefreshFile applies NeedsRefresh heuristics to an OCSP response stored
 // in a file: it will check if the file exists, parse it, then call NeedsRefresh
 // with parsed OCSP response, the file's last modification time and the given period.
 func NeedsRefreshFile(filename string, issuer *x509.Certificate, period time.Duration) (bool, *Response, error) {
+	return NeedsRefreshFileWithPolicy(filename, issuer, period, nil)
+}
+
+// NeedsRefreshFileWithPolicy is like NeedsRefreshFile but uses the given
+// policy, see NeedsRefreshWithPolicy.
+func NeedsRefreshFileWithPolicy(filename string, issuer *x509.Certificate, period time.Duration, policy RefreshPolicy) (bool, *Response, error) {
 	stats, err := os.Stat(filename)
 	if err != nil {
 		return true, nil, err
@@ -91,9 +118,40 @@ func NeedsRefreshFile(filename string, issuer *x509.Certificate, period time.Dur
 	}
 	mtime := stats.ModTime()
 	// TODO: make check period configurable
-	return NeedsRefresh(resp, mtime, period), &Response{
+	return NeedsRefreshWithPolicy(resp, mtime, period, policy), &Response{
 		OCSPResponse:    resp,
 		RawOCSPResponse: data,
 		LastModified:    mtime,
 	}, nil
 }
+
+// WriteFileAtomic writes data to the named file, atomically replacing it.
+//
+// The data is first written to a temporary file in the same directory, with
+// the same extension (so it's ignored by tools looking for files with that
+// extension), and then renamed.
+func WriteFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	ext := filepath.Ext(filename)
+	f, err := ioutil.TempFile(filepath.Dir(filename), strings.TrimSuffix(filepath.Base(filename), ext)+".*"+ext)
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, filename)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
@@ -1,6 +1,10 @@
 package ocspd
 
 import (
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -74,10 +78,42 @@ func TestNeedsRefresh(t *testing.T) {
 				NextUpdate: now.Add(23 * time.Hour),
 			},
 		},
+		{
+			name:     "Delegated signer expires before NextUpdate",
+			expected: true,
+			mtime:    now.Add(-12 * time.Hour),
+			period:   12 * time.Hour,
+			response: ocsp.Response{
+				Status:     ocsp.Good,
+				ProducedAt: now.Add(-24 * time.Hour),
+				ThisUpdate: now.Add(-24 * time.Hour),
+				NextUpdate: now.Add(72 * time.Hour),
+				Certificate: &x509.Certificate{
+					NotBefore: now.Add(-48 * time.Hour),
+					NotAfter:  now.Add(6 * time.Hour),
+				},
+			},
+		},
+		{
+			name:     "Delegated signer valid until after NextUpdate",
+			expected: false,
+			mtime:    now.Add(-12 * time.Hour),
+			period:   12 * time.Hour,
+			response: ocsp.Response{
+				Status:     ocsp.Good,
+				ProducedAt: now.Add(-24 * time.Hour),
+				ThisUpdate: now.Add(-24 * time.Hour),
+				NextUpdate: now.Add(72 * time.Hour),
+				Certificate: &x509.Certificate{
+					NotBefore: now.Add(-48 * time.Hour),
+					NotAfter:  now.Add(96 * time.Hour),
+				},
+			},
+		},
 		// TODO: test with different statuses
 	}
 	for _, test := range tests {
-		if needsRefresh(&test.response, test.mtime, test.period, now) != test.expected {
+		if needsRefresh(&test.response, test.mtime, test.period, nil, now) != test.expected {
 			var expected, actual string
 			if test.expected {
 				expected, actual = "need refresh", "didn't"
@@ -88,3 +124,30 @@ func TestNeedsRefresh(t *testing.T) {
 		}
 	}
 }
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "cert.ocsp")
+	for _, data := range []string{"first", "second"} {
+		if err := WriteFileAtomic(filename, []byte(data), 0640); err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != data {
+			t.Errorf("WriteFileAtomic: got %q, want %q", b, data)
+		}
+	}
+	stats, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := stats.Mode().Perm(); perm != 0640 {
+		t.Errorf("WriteFileAtomic: got mode %v, want %v", perm, os.FileMode(0640))
+	}
+	if names, _ := filepath.Glob(filepath.Join(dir, "*")); len(names) != 1 {
+		t.Errorf("WriteFileAtomic: got files %v, want only %s", names, filename)
+	}
+}
@@ -2,10 +2,16 @@ package ocspd
 
 import (
 	"bytes"
+	"container/heap"
+	"context"
 	"errors"
+	"fmt"
+	"log/slog"
 	"math"
 	"math/rand"
+	"net/url"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -15,12 +21,86 @@ import (
 
 const DefaultTickRound = 5 * time.Minute
 
+const (
+	DefaultBackoffMax        = time.Hour
+	DefaultBackoffMultiplier = 2
+)
+
+const DefaultCircuitBreakerThreshold = 5
+
+const DefaultConcurrency = 4
+
+const DefaultExpiryWarning = 24 * time.Hour
+
 var ErrDuplicateTag = errors.New("ocspd: duplicate tag")
 
+// EventType is the type of an Event.
+type EventType int
+
+const (
+	// EventUpdated is emitted when a new OCSP response has been fetched
+	// (or when a tag is added to an already monitored certificate).
+	EventUpdated EventType = iota
+	// EventNotModified is emitted when the OCSP responder returned
+	// the cached OCSP response.
+	EventNotModified
+	// EventFetchError is emitted when fetching an OCSP response failed.
+	EventFetchError
+	// EventExpiring is emitted when the cached OCSP response couldn't be
+	// refreshed and expires within the Updater's ExpiryWarning.
+	EventExpiring
+	// EventStatusChanged is emitted, after EventUpdated, when the status
+	// of the certificate changed (e.g. from good to revoked).
+	EventStatusChanged
+	// EventRevoked is emitted, after EventUpdated (and EventStatusChanged),
+	// when a new OCSP response reports the certificate as revoked.
+	EventRevoked
+	// EventCertExpiring is emitted after each fetch when the certificate
+	// (or its issuer) expires within the Updater's CertExpiryWarning.
+	EventCertExpiring
+	// EventCertExpired is emitted once the certificate (or its issuer) has
+	// expired; its OCSP response isn't refreshed anymore.
+	EventCertExpired
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventUpdated:
+		return "updated"
+	case EventNotModified:
+		return "not modified"
+	case EventFetchError:
+		return "fetch error"
+	case EventExpiring:
+		return "expiring"
+	case EventStatusChanged:
+		return "status changed"
+	case EventRevoked:
+		return "revoked"
+	case EventCertExpiring:
+		return "certificate expiring"
+	case EventCertExpired:
+		return "certificate expired"
+	}
+	return fmt.Sprintf("EventType(%d)", int(t))
+}
+
 type Event struct {
+	Type EventType
+	// The current OCSP response, if any
 	Response    *ocsp.Response
 	RawResponse []byte
 	Tags        []string
+	// The OCSP response before the event, if any
+	Previous *Response
+	// The error, for EventFetchError
+	Err error
+	// The number of consecutive failed fetches, for EventFetchError and
+	// EventExpiring
+	Failures int
+	// The time the certificate (or its issuer, if earlier) expires, for
+	// EventCertExpiring and EventCertExpired
+	NotAfter time.Time
 }
 
 type ocspStatus struct {
@@ -32,13 +112,106 @@ type ocspStatus struct {
 	NextUpdate time.Time
 	// The tags this status (certificate) is mapped to
 	Tags []string
+	// Whether an OCSP response is currently being fetched
+	fetching bool
+	// The number of consecutive failed fetches
+	failures int
+	// Whether the fetch has been postponed because the responder is failing
+	deferred bool
+	// Whether the fetch has been postponed until the cached response expires
+	// (or can no longer be used per stale-if-error), rather than until the
+	// next probe, and must then bypass the open circuit
+	urgent bool
+	// The key of the request in Updater.byRequest (see requestKey)
+	key string
+	// The key grouping requests by OCSP responders (see responderKey)
+	responder string
+	// The index in the Updater.statuses heap, or -1 if no longer monitored
+	index int
+	// The time of the last fetch, if any
+	lastFetch time.Time
+	// The outcome of the last fetch: EventUpdated, EventNotModified, or EventFetchError
+	lastOutcome EventType
+	// The error of the last fetch, if it failed
+	lastErr error
+	// The delivery of updates, if any
+	delivery *delivery
+	// The OnEvent and OnRevoked calls waiting for the running one to return
+	calls []func()
+	// Whether a goroutine is making the calls
+	calling bool
+	// Whether the certificate is expired, and its OCSP response no longer refreshed
+	expired bool
 }
 
+// ocspStatuses is a min-heap of statuses ordered by NextUpdate.
 type ocspStatuses []*ocspStatus
 
 func (s ocspStatuses) Len() int           { return len(s) }
-func (s ocspStatuses) Swap(i, j int)      { s[j], s[i] = s[i], s[j] }
 func (s ocspStatuses) Less(i, j int) bool { return s[i].NextUpdate.Before(s[j].NextUpdate) }
+func (s ocspStatuses) Swap(i, j int) {
+	s[j], s[i] = s[i], s[j]
+	s[i].index, s[j].index = i, j
+}
+
+func (s *ocspStatuses) Push(x interface{}) {
+	st := x.(*ocspStatus)
+	st.index = len(*s)
+	*s = append(*s, st)
+}
+
+func (s *ocspStatuses) Pop() interface{} {
+	old := *s
+	n := len(old)
+	st := old[n-1]
+	old[n-1] = nil
+	st.index = -1
+	*s = old[:n-1]
+	return st
+}
+
+// due returns the statuses that need to be refreshed at the given time,
+// and are not being fetched, ordered by NextUpdate.
+func (s ocspStatuses) due(now time.Time) []*ocspStatus {
+	var due []*ocspStatus
+	// children are never due before their parent: prune the subtrees that
+	// aren't due
+	var walk func(i int)
+	walk = func(i int) {
+		if i >= len(s) || s[i].NextUpdate.After(now) {
+			return
+		}
+		if !s[i].fetching {
+			due = append(due, s[i])
+		}
+		walk(2*i + 1)
+		walk(2*i + 2)
+	}
+	walk(0)
+	sort.Slice(due, func(i, j int) bool { return due[i].NextUpdate.Before(due[j].NextUpdate) })
+	return due
+}
+
+// next returns the earliest NextUpdate of the statuses not being fetched, if
+// any.
+func (s ocspStatuses) next() (next time.Time, ok bool) {
+	// children are never due before their parent: only walk the subtrees of
+	// the statuses being fetched
+	var walk func(i int)
+	walk = func(i int) {
+		if i >= len(s) || (ok && !s[i].NextUpdate.Before(next)) {
+			return
+		}
+		if !s[i].fetching {
+			next, ok = s[i].NextUpdate, true
+			return
+		}
+		walk(2*i + 1)
+		walk(2*i + 2)
+	}
+	walk(0)
+	return next, ok
+}
 
 // Updater schedules queries to OCSP responders at appropriate times in order
 // to maintain fresh OCSP responses for a set of certificates.
@@ -46,37 +219,244 @@ func (s ocspStatuses) Less(i, j int) bool { return s[i].NextUpdate.Before(s[j].N
 // Queries are scheduled such that the OCSP responses are always fresh but
 // but without hammering the OCSP responders, hopefully making a single query
 // at the appropriate time to get a fresh response (rather than the same that's
-// already cached).
+// already cached). The times of the queries are determined by the
+// RefreshPolicy, or DefaultRefreshPolicy if nil.
 //
 // Internally, Updater organizes certificates in such a way that if
 // a certificate is added twice it won't cause more work to be done;
 // a certificate can thus be associated to several "tags".
 //
 // Whenever the OCSP response for a certificate is refreshed, the
-// OnUpdate function is called.
+// OnUpdate function is called. Updates are delivered in order: OnUpdate is
+// never called concurrently for the same certificate, and if several updates
+// are waiting for a previous call to return, only the latest one is
+// delivered. DeliverUpdate can be used instead of OnUpdate to report failures,
+// in which case the delivery is retried (unless superseded by a newer
+// update), as configured by DeliveryBackoff. The OnEvent function is called
+// for all events, including failures. OnEvent and OnRevoked are called in the
+// order of the events, never concurrently for the same certificate.
+//
+// Whenever a new OCSP response reports a certificate as revoked, the
+// OnRevoked function is called; if WithholdRevoked is true, OnUpdate
+// isn't called with revoked responses.
+//
+// Failed fetches are retried with an exponential backoff, as configured by
+// Backoff, and requests to OCSP responders that keep failing are paused, as
+// configured by CircuitBreaker. A Retry-After sent by an OCSP responder is
+// honored up to the Backoff's Max. Fetches are never postponed after the
+// cached OCSP response expires or its StaleIfError window ends.
+//
+// The HTTP caching headers of OCSP responses are honored: a response is
+// refreshed once its MaxAge is reached, or at a random time before its
+// StaleWhileRevalidate if the responder allows it to be used while it's being
+// refreshed. Failed fetches within the StaleIfError window of the cached
+// response are expected outages of the responder: the cached response keeps
+// being served, they're only logged at Info level, and retried before the end
+// of the window.
 type Updater struct {
-	OnUpdate  func(Event)
-	TickRound time.Duration
-	Log       func(format string, v ...interface{})
-	Fetcher   *Fetcher
+	OnUpdate        func(Event)
+	DeliverUpdate   func(Event) error
+	OnEvent         func(Event)
+	OnRevoked       func(Event)
+	WithholdRevoked bool
+	TickRound       time.Duration
+	RefreshPolicy   RefreshPolicy
+	Backoff         Backoff
+	CircuitBreaker  CircuitBreaker
+	Fetcher         *Fetcher
+
+	// Logger receives structured log records, using the LogKey* attributes;
+	// if nil, Log is used.
+	Logger *slog.Logger
+	// Log is a printf-style function receiving the log records, as formatted
+	// by NewLogFuncHandler, if Logger is nil; it must not be changed once the
+	// Updater is used.
+	//
+	// Deprecated: use Logger.
+	Log func(format string, v ...interface{})
+	// Metrics receives measurements of the fetches; if nil, they're
+	// discarded.
+	Metrics Metrics
+
+	// Concurrency is the maximum number of OCSP responses fetched in
+	// parallel; if zero, DefaultConcurrency is used.
+	Concurrency int
+	// ConcurrencyPerHost is the maximum number of OCSP responses fetched in
+	// parallel from the same OCSP responders; zero means no limit other than
+	// Concurrency.
+	ConcurrencyPerHost int
+
+	// DeliveryBackoff configures the delays between retries of failed
+	// DeliverUpdate calls; if its Initial is zero,
+	// DefaultDeliveryBackoffInitial is used.
+	DeliveryBackoff Backoff
+
+	// StartupSpread is the window over which the first fetches of the
+	// certificates added (or whose state is loaded) before the Updater starts
+	// running are randomly spread, if they're due within it and their cached
+	// OCSP responses are still valid; zero means no spreading.
+	StartupSpread time.Duration
+
+	// CertExpiryWarning is how long before the certificate (or its issuer)
+	// expires EventCertExpiring starts being emitted; if zero, it's never
+	// emitted.
+	CertExpiryWarning time.Duration
+
+	// ExpiryWarning is how long before the cached OCSP response expires
+	// EventExpiring starts being emitted; if zero, DefaultExpiryWarning is
+	// used.
+	ExpiryWarning time.Duration
+
+	// StateFile is the file where the scheduling state (HTTP caching
+	// information, failures and time of the next fetch) is saved after each
+	// UpdateNow (and shortly after fetches made by Run), to be restored by
+	// LoadState; if empty, the state isn't saved.
+	StateFile string
 
 	mu          sync.Mutex
 	statuses    ocspStatuses
+	byRequest   map[string]*ocspStatus
 	tagToStatus map[string]*ocspStatus
+	circuits    map[string]*circuit
 	timer       *time.Timer
-	done        chan struct{}
+	cancel      context.CancelFunc
+	saved       map[string]savedStatus
+	savePending bool
+	saveMu      sync.Mutex
+	fetches     int
+	perHost     map[string]int
+	fetchDone   *sync.Cond
+	blocked     bool
+	callbacks   int
+	shutdown    chan struct{}
+	abort       chan struct{}
+	idle        chan struct{}
+	shutDown    bool
+	aborted     bool
+
+	// The adapter of Log, see logger
+	logFuncOnce   sync.Once
+	logFuncLogger *slog.Logger
 
 	rand func(time.Duration) time.Duration
 }
 
+// Backoff configures the delays between retries of failed fetches.
+//
+// The n-th consecutive retry is scheduled Initial*Multiplier^(n-1) after
+// the failure, capped at Max, and never after the cached OCSP response
+// (if any) expires or its StaleIfError window ends.
+type Backoff struct {
+	// Initial is the delay before the first retry; if zero, the Updater's
+	// TickRound is used.
+	Initial time.Duration
+	// Max is the maximum delay between retries; if zero, DefaultBackoffMax
+	// is used.
+	Max time.Duration
+	// Multiplier is the factor applied to the delay after each failure;
+	// if less than 1, DefaultBackoffMultiplier is used.
+	Multiplier float64
+	// Jitter is the fraction of the delay, between 0 and 1, that's randomly
+	// subtracted from it to spread retries over time; zero means no jitter.
+	Jitter float64
+}
+
+// delay returns the delay before the retry following the given number of
+// consecutive failures (including the last one).
+func (b *Backoff) delay(failures int, initial time.Duration, r func(time.Duration) time.Duration) time.Duration {
+	if b.Initial > 0 {
+		initial = b.Initial
+	}
+	max := b.max()
+	multiplier := b.Multiplier
+	if multiplier < 1 {
+		multiplier = DefaultBackoffMultiplier
+	}
+	d := float64(initial)
+	for i := 1; i < failures && d < float64(max); i++ {
+		d *= multiplier
+	}
+	if d > float64(max) {
+		d = float64(max)
+	}
+	if b.Jitter > 0 {
+		j := time.Duration(d * math.Min(b.Jitter, 1))
+		return time.Duration(d) - j + r(j)
+	}
+	return time.Duration(d)
+}
+
+func (b *Backoff) max() time.Duration {
+	if b.Max > 0 {
+		return b.Max
+	}
+	return DefaultBackoffMax
+}
+
+// CircuitBreaker configures how requests to failing OCSP responders are
+// paused.
+//
+// Certificates are grouped by the hosts of their OCSP responders. After
+// Threshold consecutive failed fetches in a group, the circuit opens and
+// the group's fetches are postponed, except for a single probe every
+// HalfOpenInterval; the circuit closes as soon as a fetch succeeds.
+type CircuitBreaker struct {
+	// Threshold is the number of consecutive failed fetches after which
+	// the circuit opens; if zero, DefaultCircuitBreakerThreshold is used,
+	// and if negative, the circuit never opens.
+	Threshold int
+	// HalfOpenInterval is the delay between probes while the circuit is
+	// open; if zero, the Updater's TickRound is used.
+	HalfOpenInterval time.Duration
+}
+
+func (c *CircuitBreaker) threshold() int {
+	if c.Threshold == 0 {
+		return DefaultCircuitBreakerThreshold
+	}
+	return c.Threshold
+}
+
+// circuit tracks the failures of a group of OCSP responders.
+type circuit struct {
+	// The number of consecutive failed fetches
+	failures int
+	// Whether requests are paused
+	open bool
+	// The next time a probe can be sent, when the circuit is open
+	probeAt time.Time
+}
+
+// responderKey returns the key grouping requests by OCSP responder hosts.
+func responderKey(req *Request) string {
+	hosts := make([]string, len(req.endpoints))
+	for i := range req.endpoints {
+		hosts[i] = req.endpoints[i].host()
+	}
+	return strings.Join(hosts, ", ")
+}
+
+// host returns the host of the OCSP responder, or its whole URL if it has
+// none.
+func (e *endpoint) host() string {
+	if u, err := url.Parse(e.url); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return e.url
+}
+
 func defaultRand(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
 	return time.Duration(rand.Int63n(int64(d)))
 }
 
 // AddOrUpdate adds a certificate to be monitored, with an optional response
 // (generally coming from a cache).
 //
-// The OCSPResponse and MaxAge in resp will be used to schedule the next update,
+// The OCSPResponse, MaxAge and StaleWhileRevalidate in resp will be used to
+// schedule the next update,
 // the ETag and LastModified will be used for the next update if provided;
 // RawOCSPResponse is never used.
 //
@@ -92,40 +472,43 @@ func (u *Updater) AddOrUpdate(tag string, req *Request, resp *Response) error {
 	u.mu.Lock()
 	defer u.mu.Unlock()
 	// first do a lookup by tag, as it's the fastest and it checks for duplicate tags
-	if s, ok := u.tagToStatus[tag]; ok {
+	s, ok := u.tagToStatus[tag]
+	if ok {
 		if !requestEqual(req, s.Request) {
 			return ErrDuplicateTag
 		}
 		u.updateStatus(s, resp)
 	} else {
 		// lookup by OCSP request
-		var found bool
-		var s *ocspStatus
-		for _, s = range u.statuses {
-			if !requestEqual(req, s.Request) {
-				continue
-			}
+		key := requestKey(req)
+		if s, ok = u.byRequest[key]; ok {
 			s.Tags = append(s.Tags, tag)
 			sort.Strings(s.Tags)
 			u.updateStatus(s, resp)
 			if resp == nil && s.Response != nil && u.isStarted() {
-				u.onUpdate(Event{
+				u.emit(s, Event{
+					Type:        EventUpdated,
 					Response:    s.Response.OCSPResponse,
 					RawResponse: s.Response.RawOCSPResponse,
-					Tags:        s.Tags,
 				})
 			}
-			found = true
-			break
-		}
-		if !found {
+		} else {
 			// need to insert
 			s = &ocspStatus{
-				Request: req,
-				Tags:    []string{tag},
+				Request:   req,
+				Tags:      []string{tag},
+				key:       key,
+				responder: responderKey(req),
+				index:     -1,
 			}
 			u.updateStatus(s, resp)
-			u.statuses = append(u.statuses, s)
+			heap.Push(&u.statuses, s)
+			u.restoreStatus(s)
+			u.spreadStartup(s)
+			if u.byRequest == nil {
+				u.byRequest = make(map[string]*ocspStatus)
+			}
+			u.byRequest[key] = s
 		}
 		if u.tagToStatus == nil {
 			u.tagToStatus = make(map[string]*ocspStatus)
@@ -139,9 +522,39 @@ func (u *Updater) AddOrUpdate(tag string, req *Request, resp *Response) error {
 func requestEqual(a, b *Request) bool {
 	// No need to compare the issuers, their information is included in the OCSP requests,
 	// encoded into the url or body.
-	return a.url == b.url &&
-		(a.body == nil) == (b.body == nil) &&
-		bytes.Equal(a.body, b.body)
+	if len(a.endpoints) != len(b.endpoints) || a.nonceLength != b.nonceLength {
+		return false
+	}
+	for i := range a.endpoints {
+		ea, eb := &a.endpoints[i], &b.endpoints[i]
+		if ea.url != eb.url ||
+			(ea.body == nil) != (eb.body == nil) ||
+			!bytes.Equal(ea.body, eb.body) {
+			return false
+		}
+	}
+	return true
+}
+
+// requestKey returns a key such that requests are equal (as determined by
+// requestEqual) iff their keys are equal.
+func requestKey(req *Request) string {
+	var b strings.Builder
+	b.WriteString(strconv.Itoa(req.nonceLength))
+	for _, e := range req.endpoints {
+		b.WriteString("|")
+		b.WriteString(strconv.Itoa(len(e.url)))
+		b.WriteString(":")
+		b.WriteString(e.url)
+		if e.body == nil {
+			b.WriteString("-")
+		} else {
+			b.WriteString(strconv.Itoa(len(e.body)))
+			b.WriteString(":")
+			b.Write(e.body)
+		}
+	}
+	return b.String()
 }
 
 func (u *Updater) Remove(tag string) {
@@ -158,151 +571,714 @@ func (u *Updater) Remove(tag string) {
 		}
 		if len(s.Tags) == 0 {
 			// no tag left: we need to remove the OCSP status entirely
-			for i := range u.statuses {
-				if s == u.statuses[i] {
-					u.statuses = append(u.statuses[:i], u.statuses[i+1:]...)
-					break
-				}
-			}
+			u.stopDelivery(s)
+			heap.Remove(&u.statuses, s.index)
+			delete(u.byRequest, s.key)
 		}
-		u.log("%s no longer monitored\n", tag)
+		u.logger().Info("certificate no longer monitored", LogKeyTags, []string{tag})
 		u.resetTimer()
 	}
 }
 
-// Start begins scheduling OCSP fetches for the monitored certificates.
+var errAlreadyRunning = errors.New("ocspd: updater is already running")
+
+// ErrUpdaterShutdown is returned by Run after a call to Shutdown.
+var ErrUpdaterShutdown = errors.New("ocspd: updater shut down")
+
+// Run schedules OCSP fetches for the monitored certificates until ctx is done.
 //
-// It schedules calls to UpdateNow at specific times to always maintain
-// monitored certificates' OCSP responses up to date.
+// It schedules calls to UpdateNowContext at specific times to always maintain
+// monitored certificates' OCSP responses up to date. Ongoing fetches are
+// aborted when ctx is done.
 //
-// It's a no-op if the Updater is already started, and blocks otherwise.
-func (u *Updater) Start() {
-	if !u.startTimer() {
-		return
+// Run blocks until ctx is done and then returns ctx.Err(), or until Shutdown
+// is called and then returns ErrUpdaterShutdown. It returns an error
+// immediately if the Updater is already running.
+func (u *Updater) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	timer, shutdown, abort, err := u.startTimer(cancel)
+	if err != nil {
+		return err
 	}
+	defer u.stopTimer()
+	go func() {
+		select {
+		case <-abort:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
 	for {
 		select {
-		case <-u.timer.C:
-			u.UpdateNow()
-		case <-u.done:
-			return
+		case <-timer.C:
+			u.fetchDue(ctx)
+		case <-shutdown:
+			// let Shutdown wait for (or abort) the in-flight fetches
+			u.mu.Lock()
+			for u.fetches > 0 {
+				u.fetchCond().Wait()
+			}
+			u.mu.Unlock()
+			return ErrUpdaterShutdown
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 	}
 }
 
-func (u *Updater) startTimer() bool {
+// Start begins scheduling OCSP fetches for the monitored certificates.
+//
+// It's a no-op if the Updater is already started, and blocks otherwise.
+//
+// Deprecated: use Run with a cancellable context.
+func (u *Updater) Start() {
+	u.Run(context.Background())
+}
+
+func (u *Updater) startTimer(cancel context.CancelFunc) (timer *time.Timer, shutdown, abort <-chan struct{}, err error) {
 	u.mu.Lock()
 	defer u.mu.Unlock()
+	if u.shutDown {
+		return nil, nil, nil, ErrUpdaterShutdown
+	}
 	if u.isStarted() {
-		return false
+		return nil, nil, nil, errAlreadyRunning
 	}
 	u.timer = time.NewTimer(math.MaxInt64)
-	u.done = make(chan struct{})
+	u.cancel = cancel
 	u.resetTimer()
-	return true
+	shutdown, abort = u.shutdownChans()
+	return u.timer, shutdown, abort, nil
+}
+
+func (u *Updater) stopTimer() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.timer.Stop()
+	u.timer = nil
+	u.cancel = nil
 }
 
 func (u *Updater) isStarted() bool {
 	return u.timer != nil
 }
 
-// Stop terminates the scheduled monitoring.
+// Stop terminates the scheduled monitoring started with Start (or Run),
+// aborting ongoing fetches.
 //
-// It waits for ongoing fetches and only prevents future fetches from being scheduled.
+// Deprecated: use Run with a cancellable context.
 func (u *Updater) Stop() {
 	u.mu.Lock()
-	defer u.mu.Unlock()
-	if !u.isStarted() {
-		return
+	cancel := u.cancel
+	u.mu.Unlock()
+	if cancel != nil {
+		cancel()
 	}
-	u.timer.Stop()
-	u.timer = nil
-	u.done <- struct{}{}
-	close(u.done)
-	u.done = nil
 }
 
 func (u *Updater) resetTimer() {
 	if !u.isStarted() {
 		return
 	}
-	if len(u.statuses) == 0 {
+	next, ok := u.statuses.next()
+	if !ok || u.shutDown || u.blocked {
+		// if blocked, the timer is reset when an in-flight fetch finishes
 		u.timer.Stop()
 		return
 	}
-	sort.Sort(u.statuses)
-	d := u.statuses[0].NextUpdate.Sub(u.Fetcher.now())
-	u.timer.Reset(d)
+	u.timer.Reset(next.Sub(u.Fetcher.now()))
 }
 
 // UpdateNow fetches OCSP responses that needs to be refreshed.
 func (u *Updater) UpdateNow() {
+	u.UpdateNowContext(context.Background())
+}
+
+// UpdateNowContext fetches OCSP responses that needs to be refreshed,
+// aborting if ctx is done.
+//
+// Up to Concurrency responses are fetched in parallel, and no more than
+// ConcurrencyPerHost from the same OCSP responders (if non-zero).
+// The Updater is not locked while querying the OCSP responders, so
+// certificates can be added or removed concurrently.
+func (u *Updater) UpdateNowContext(ctx context.Context) {
+	// write the state once unlocked
+	defer u.flushState()
 	u.mu.Lock()
 	defer u.mu.Unlock()
+	if u.shutDown || ctx.Err() != nil {
+		// Run can pick the timer after ctx is done
+		return
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	_, abort := u.shutdownChans()
+	go func() {
+		select {
+		case <-abort:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
 
-	for _, s := range u.statuses {
-		if s.NextUpdate.After(u.Fetcher.now()) {
+	due := u.statuses.due(u.Fetcher.now())
+
+	cond := u.fetchCond()
+	var pending int
+	skipped := make(map[string]int)
+	for len(due) > 0 && ctx.Err() == nil && !u.shutDown {
+		if u.fetches >= u.concurrency() {
+			cond.Wait()
+			continue
+		}
+		// pick the first status whose OCSP responders aren't too busy
+		i := 0
+		for i < len(due) && u.hostBusy(due[i]) {
+			i++
+		}
+		if i == len(due) {
+			cond.Wait()
+			continue
+		}
+		s := due[i]
+		due = append(due[:i], due[i+1:]...)
+		if s.fetching {
+			// started by Run in the mean time
+			continue
+		}
+		if u.startFetch(ctx, s, skipped, func() { pending-- }) {
+			pending++
+		}
+	}
+	for pending > 0 {
+		cond.Wait()
+	}
+	u.logSkipped(skipped)
+	u.savePending = u.StateFile != ""
+	u.resetTimer()
+}
+
+// fetchDue starts fetching the OCSP responses that need to be refreshed, as
+// many as Concurrency and ConcurrencyPerHost allow, without waiting for them;
+// the others are started as the in-flight fetches finish.
+func (u *Updater) fetchDue(ctx context.Context) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.shutDown || ctx.Err() != nil {
+		return
+	}
+	u.blocked = false
+	skipped := make(map[string]int)
+	for _, s := range u.statuses.due(u.Fetcher.now()) {
+		if u.fetches >= u.concurrency() {
+			u.blocked = true
 			break
 		}
-		tags := strings.Join(s.Tags, ", ")
-		u.log("Fetching OCSP response for %s\n", tags)
-		r, err := u.Fetcher.FetchR(s.Request, s.Response)
-		if err != nil {
-			u.log("Error while fetching OCSP response for %s: %s\n", tags, err.Error())
-			// retry asap
-			// TODO: exponential backoff
-			// TODO: skip other requests with same ResponderURL
-			s.NextUpdate = s.NextUpdate.Add(u.tickRound())
+		if u.hostBusy(s) {
+			u.blocked = true
+			continue
+		}
+		u.startFetch(ctx, s, skipped, nil)
+	}
+	u.logSkipped(skipped)
+	u.resetTimer()
+}
+
+// startFetch fetches the OCSP response of s in a new goroutine, unless the
+// certificate is no longer monitored or expired, or the circuit of its OCSP
+// responders is open (s is then counted in skipped); it returns whether the
+// fetch started.
+//
+// Once the fetch is finished, the status is updated, done is called (if
+// non-nil) and the next fetch is scheduled.
+func (u *Updater) startFetch(ctx context.Context, s *ocspStatus, skipped map[string]int, done func()) bool {
+	if !u.isMonitored(s) {
+		// removed while fetching another response
+		return false
+	}
+	if u.Fetcher.now().After(s.Request.notAfter) {
+		u.certExpired(s)
+		return false
+	}
+	key := s.responder
+	if c := u.circuits[key]; c != nil && c.open {
+		now := u.Fetcher.now()
+		if s.urgent {
+			// the cached response can't wait for the next probe
+			u.logger().Info("fetching OCSP response from failing responder before the cached one expires", LogKeyTags, s.Tags, LogKeyResponder, key)
+		} else if now.Before(c.probeAt) {
+			u.postpone(s, c)
+			u.checkExpiring(s)
+			skipped[key]++
+			return false
 		} else {
-			if r == nil {
-				u.log("Fetched OCSP response for %s: up-to-date.\n", tags)
-			} else {
-				u.log("Fetched OCSP response for %s\n", tags)
+			// half-open: let a single request through
+			c.probeAt = now.Add(u.halfOpenInterval())
+			u.logger().Info("probing OCSP responder", LogKeyResponder, key)
+		}
+	}
+	tags := append([]string(nil), s.Tags...)
+	u.logger().Debug("fetching OCSP response", LogKeyTags, tags)
+	req, prev := s.Request, s.Response
+	s.fetching = true
+	u.fetches++
+	if u.perHost == nil {
+		u.perHost = make(map[string]int)
+	}
+	u.perHost[key]++
+	go func() {
+		r, err := u.Fetcher.revalidate(ctx, req, prev)
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		u.fetched(ctx, s, key, tags, r, err)
+		if done != nil {
+			done()
+		}
+		u.fetches--
+		if u.perHost[key]--; u.perHost[key] == 0 {
+			delete(u.perHost, key)
+		}
+		u.blocked = false
+		u.fetchCond().Broadcast()
+		u.checkIdle()
+		if done == nil {
+			u.scheduleSave()
+		}
+		u.resetTimer()
+	}()
+	return true
+}
+
+// hostBusy returns whether ConcurrencyPerHost responses are already being
+// fetched from the OCSP responders of s.
+func (u *Updater) hostBusy(s *ocspStatus) bool {
+	return u.ConcurrencyPerHost > 0 && u.perHost[s.responder] >= u.ConcurrencyPerHost
+}
+
+// fetchCond returns the condition signalled whenever a fetch finishes.
+func (u *Updater) fetchCond() *sync.Cond {
+	if u.fetchDone == nil {
+		u.fetchDone = sync.NewCond(&u.mu)
+	}
+	return u.fetchDone
+}
+
+// logSkipped logs the number of fetches postponed because the circuit of
+// their OCSP responders is open.
+func (u *Updater) logSkipped(skipped map[string]int) {
+	for key, n := range skipped {
+		if c := u.circuits[key]; c != nil && c.open {
+			u.logger().Warn("postponed OCSP requests to failing responder", LogKeyResponder, key, "count", n, LogKeyNextFetch, c.probeAt)
+		}
+	}
+}
+
+// fetched updates the status with the result of a fetch.
+func (u *Updater) fetched(ctx context.Context, s *ocspStatus, key string, tags []string, r *Response, err error) {
+	s.fetching = false
+	if err != nil && ctx.Err() != nil {
+		u.logger().Info("aborted fetching OCSP response", LogKeyTags, tags, errorAttr(ctx.Err()))
+		return
+	}
+	if !u.isMonitored(s) {
+		u.logger().Info("discarding OCSP response: certificate no longer monitored", LogKeyTags, tags)
+		return
+	}
+	if err == ErrCertExpired {
+		u.certExpired(s)
+		return
+	}
+	s.deferred, s.urgent = false, false
+	s.lastFetch, s.lastErr = u.Fetcher.now(), err
+	s.lastOutcome = fetchOutcome(r, err)
+	u.metrics().ObserveFetch(key, s.lastOutcome)
+	defer u.checkCertExpiring(s)
+	if err != nil {
+		attrs := []any{LogKeyTags, tags, LogKeyResponder, key, errorAttr(err)}
+		var ra time.Time
+		if se, ok := err.(HTTPStatusError); ok {
+			ra = se.RetryAfter
+			if max := s.lastFetch.Add(u.Backoff.max()); ra.After(max) {
+				ra = max
 			}
-			u.updateStatus(s, r)
-			if r != nil {
-				u.onUpdate(Event{
-					Response:    r.OCSPResponse,
-					RawResponse: r.RawOCSPResponse,
-					Tags:        s.Tags,
-				})
+			attrs = append(attrs, LogKeyHTTPStatus, se.StatusCode)
+		}
+		if s.Response != nil && s.Response.StaleIfError.After(s.lastFetch) {
+			u.logger().Info("error while fetching OCSP response, serving cached one as allowed by stale-if-error", append(attrs, "until", s.Response.StaleIfError)...)
+		} else {
+			u.logger().Warn("error while fetching OCSP response", attrs...)
+		}
+		u.scheduleRetry(s, ra)
+		if c := u.responderFailed(key, ra); c != nil && c.open && s.NextUpdate.Before(c.probeAt) {
+			u.postpone(s, c)
+		}
+		ev := Event{
+			Type:     EventFetchError,
+			Previous: s.Response,
+			Err:      err,
+			Failures: s.failures,
+		}
+		if s.Response != nil {
+			ev.Response, ev.RawResponse = s.Response.OCSPResponse, s.Response.RawOCSPResponse
+		}
+		u.emit(s, ev)
+		u.checkExpiring(s)
+		return
+	}
+	u.responderSucceeded(key)
+	s.failures = 0
+	prev := s.Response
+	if r.OCSPResponse == nil {
+		u.logger().Info("fetched OCSP response: up-to-date", LogKeyTags, tags)
+		if prev == nil {
+			r = nil
+		} else {
+			// the cached response is fresh again, as told by the 304
+			cached := *prev
+			cached.MaxAge = r.MaxAge
+			cached.StaleWhileRevalidate, cached.StaleIfError = r.StaleWhileRevalidate, r.StaleIfError
+			if r.Etag != "" {
+				cached.Etag = r.Etag
+			}
+			if !r.LastModified.IsZero() {
+				cached.LastModified = r.LastModified
 			}
+			r = &cached
 		}
+		u.updateStatus(s, r)
+		ev := Event{
+			Type:     EventNotModified,
+			Previous: prev,
+		}
+		if prev != nil {
+			ev.Response, ev.RawResponse = prev.OCSPResponse, prev.RawOCSPResponse
+		}
+		u.emit(s, ev)
+		return
+	}
+	u.logger().Info("fetched OCSP response", LogKeyTags, tags, LogKeyStatus, statusString(r.OCSPResponse.Status))
+	u.updateStatus(s, r)
+	ev := Event{
+		Type:        EventUpdated,
+		Response:    r.OCSPResponse,
+		RawResponse: r.RawOCSPResponse,
+		Previous:    prev,
+	}
+	u.emit(s, ev)
+	if prev != nil && prev.OCSPResponse != nil && prev.OCSPResponse.Status != r.OCSPResponse.Status {
+		u.logger().Warn("OCSP status changed", LogKeyTags, tags, LogKeyPreviousStatus, statusString(prev.OCSPResponse.Status), LogKeyStatus, statusString(r.OCSPResponse.Status))
+		ev.Type = EventStatusChanged
+		u.emit(s, ev)
+	}
+	if r.OCSPResponse.Status == ocsp.Revoked {
+		u.logger().Error("certificate revoked", LogKeyTags, tags, LogKeyStatus, statusString(r.OCSPResponse.Status))
+		ev.Type = EventRevoked
+		u.emit(s, ev)
+	}
+}
+
+// checkExpiring emits EventExpiring if the cached OCSP response of s expires
+// within the ExpiryWarning.
+func (u *Updater) checkExpiring(s *ocspStatus) {
+	if s.Response == nil || s.Response.OCSPResponse == nil {
+		return
+	}
+	expiry := responseExpiry(s.Response.OCSPResponse)
+	if expiry.IsZero() || expiry.After(u.Fetcher.now().Add(u.expiryWarning())) {
+		return
+	}
+	u.logger().Warn("OCSP response expiring", LogKeyTags, s.Tags, LogKeyExpiry, expiry, LogKeyFailures, s.failures)
+	u.emit(s, Event{
+		Type:        EventExpiring,
+		Response:    s.Response.OCSPResponse,
+		RawResponse: s.Response.RawOCSPResponse,
+		Previous:    s.Response,
+		Failures:    s.failures,
+	})
+}
+
+// checkCertExpiring emits EventCertExpiring if the certificate of s expires
+// within the CertExpiryWarning.
+func (u *Updater) checkCertExpiring(s *ocspStatus) {
+	if u.CertExpiryWarning <= 0 || s.expired {
+		return
+	}
+	notAfter := s.Request.notAfter
+	if notAfter.After(u.Fetcher.now().Add(u.CertExpiryWarning)) {
+		return
+	}
+	u.logger().Warn("certificate expiring", LogKeyTags, s.Tags, LogKeyExpiry, notAfter)
+	u.emit(s, Event{
+		Type:     EventCertExpiring,
+		Previous: s.Response,
+		NotAfter: notAfter,
+	})
+}
+
+// never is the NextUpdate of expired certificates; it can be marshaled to
+// JSON, unlike the maximum time.Time.
+var never = time.Date(9999, time.December, 31, 23, 59, 59, 0, time.UTC)
+
+// certExpired stops refreshing the OCSP response of s, emitting
+// EventCertExpired.
+func (u *Updater) certExpired(s *ocspStatus) {
+	s.expired = true
+	s.NextUpdate = never
+	u.fix(s)
+	u.logger().Warn("certificate expired, no longer refreshing its OCSP response", LogKeyTags, s.Tags, LogKeyExpiry, s.Request.notAfter)
+	ev := Event{
+		Type:     EventCertExpired,
+		Previous: s.Response,
+		NotAfter: s.Request.notAfter,
+	}
+	if s.Response != nil {
+		ev.Response, ev.RawResponse = s.Response.OCSPResponse, s.Response.RawOCSPResponse
+	}
+	u.emit(s, ev)
+}
+
+var statusStrings = map[int]string{
+	ocsp.Good:    "good",
+	ocsp.Unknown: "unknown",
+	ocsp.Revoked: "revoked",
+}
+
+func statusString(status int) string {
+	if s, ok := statusStrings[status]; ok {
+		return s
+	}
+	return strconv.Itoa(status)
+}
+
+// responderFailed records a failed fetch, opening the circuit if needed.
+//
+// A non-zero retryAfter opens the circuit until then, whatever the number of
+// failures.
+func (u *Updater) responderFailed(key string, retryAfter time.Time) *circuit {
+	threshold := u.CircuitBreaker.threshold()
+	if threshold < 0 {
+		return nil
+	}
+	c := u.circuits[key]
+	if c == nil {
+		c = &circuit{}
+		if u.circuits == nil {
+			u.circuits = make(map[string]*circuit)
+		}
+		u.circuits[key] = c
+	}
+	c.failures++
+	if !c.open && c.failures >= threshold {
+		c.open = true
+		c.probeAt = u.Fetcher.now().Add(u.halfOpenInterval())
+		u.logger().Warn("OCSP responder failing, postponing requests", LogKeyResponder, key, LogKeyFailures, c.failures, LogKeyNextFetch, c.probeAt)
+	}
+	if retryAfter.After(u.Fetcher.now()) && (!c.open || retryAfter.After(c.probeAt)) {
+		c.open = true
+		c.probeAt = retryAfter
+		u.logger().Warn("OCSP responder asked to retry later, postponing requests", LogKeyResponder, key, LogKeyNextFetch, c.probeAt)
+	}
+	return c
+}
+
+func (u *Updater) responderSucceeded(key string) {
+	c := u.circuits[key]
+	if c == nil {
+		return
+	}
+	delete(u.circuits, key)
+	if !c.open {
+		return
+	}
+	u.logger().Info("OCSP responder recovered", LogKeyResponder, key, LogKeyFailures, c.failures)
+	// resume postponed requests asap
+	for _, s := range u.statuses {
+		if s.deferred && s.responder == key {
+			s.NextUpdate, s.deferred, s.urgent = time.Time{}, false, false
+		}
+	}
+	heap.Init(&u.statuses)
+}
+
+func (u *Updater) isMonitored(s *ocspStatus) bool {
+	return s.index >= 0
+}
+
+// fix restores the ordering of the statuses after s.NextUpdate changed.
+func (u *Updater) fix(s *ocspStatus) {
+	if s.index >= 0 {
+		heap.Fix(&u.statuses, s.index)
 	}
-	u.resetTimer()
 }
 
 func (u *Updater) updateStatus(s *ocspStatus, r *Response) {
 	var resp *ocsp.Response
-	var maxAge time.Time
+	var maxAge, expiry time.Time
 	if r != nil {
 		resp, maxAge = r.OCSPResponse, r.MaxAge
 		s.Response = r
 	}
-	if !maxAge.IsZero() && (resp == nil || maxAge.Before(resp.NextUpdate)) {
+	if s.expired {
+		s.NextUpdate = never
+		u.fix(s)
+		return
+	}
+	if resp != nil {
+		// refresh before the delegated signer certificate expires, if earlier than NextUpdate
+		expiry = responseExpiry(resp)
+	}
+	if !maxAge.IsZero() && (resp == nil || maxAge.Before(expiry)) {
 		s.NextUpdate = maxAge
-		u.log("Update of %s scheduled at %v\n", strings.Join(s.Tags, ","), s.NextUpdate)
+		if swr := r.StaleWhileRevalidate; swr.After(maxAge) {
+			if resp != nil && swr.After(expiry) {
+				swr = expiry
+			}
+			// refresh in the background while the cached response can still
+			// be used, spreading the load on OCSP responders
+			s.NextUpdate = maxAge.Add(u.randFunc()(swr.Sub(maxAge)))
+		}
+		// the response can already be stale (e.g. when served from a cache),
+		// don't refresh it over and over again
+		if earliest := u.Fetcher.now().Add(u.tickRound()); s.NextUpdate.Before(earliest) {
+			s.NextUpdate = earliest
+		}
+		u.logger().Debug("update scheduled", LogKeyTags, s.Tags, LogKeyNextFetch, s.NextUpdate)
 	} else if resp != nil {
 		now := u.Fetcher.now()
-		if resp.NextUpdate.Before(now) {
-			// update asap
-			s.NextUpdate = time.Time{}
-			u.log("Update of %s scheduled asap\n", strings.Join(s.Tags, ","))
+		if refreshAsap(resp, now) {
+			s.NextUpdate = u.asap(s)
+			u.logger().Debug("update scheduled asap", LogKeyTags, s.Tags)
 		} else {
-			earliest := now.Add(u.tickRound())
-			h := resp.NextUpdate.Sub(earliest) / 2
-			r := u.rand
-			if r == nil {
-				r = defaultRand
+			next := u.refreshPolicy().NextRefresh(resp, now)
+			if earliest := now.Add(u.tickRound()); next.Before(earliest) {
+				next = earliest
+			}
+			if p, ok := u.refreshPolicy().(spreadRefreshPolicy); ok {
+				// spread the load on OCSP responders
+				next = next.Add(u.randFunc()(p.spread(resp, next)))
 			}
-			s.NextUpdate = earliest.Add(h + r(h)).Truncate(u.TickRound)
-			u.log("Update of %s scheduled at %v\n", strings.Join(s.Tags, ","), s.NextUpdate)
+			s.NextUpdate = next.Truncate(u.TickRound)
+			u.logger().Debug("update scheduled", LogKeyTags, s.Tags, LogKeyNextFetch, s.NextUpdate)
 		}
-	} else if s.Response == nil {
-		// update asap
-		s.NextUpdate = time.Time{}
-		u.log("Update of %s scheduled asap\n", strings.Join(s.Tags, ","))
+	} else if s.Response == nil || s.Response.OCSPResponse == nil {
+		s.NextUpdate = u.asap(s)
+		u.logger().Debug("update scheduled asap", LogKeyTags, s.Tags)
+	}
+	u.fix(s)
+}
+
+// asap returns when to refresh s asap: right away if it's never been
+// fetched, otherwise not before a tick from now, so as not to query the OCSP
+// responders over and over again when they keep returning stale responses.
+func (u *Updater) asap(s *ocspStatus) time.Time {
+	if s.lastFetch.IsZero() {
+		return time.Time{}
+	}
+	return u.Fetcher.now().Add(u.tickRound())
+}
+
+// spreadStartup postpones the first fetch of s to a random time within the
+// StartupSpread (but before its cached OCSP response expires) if it's due
+// within that window and the Updater isn't running yet.
+func (u *Updater) spreadStartup(s *ocspStatus) {
+	if u.StartupSpread <= 0 || u.isStarted() || s.expired || s.Response == nil || s.Response.OCSPResponse == nil {
+		return
+	}
+	now := u.Fetcher.now()
+	end := now.Add(u.StartupSpread)
+	if !s.NextUpdate.Before(end) || refreshAsap(s.Response.OCSPResponse, now) {
+		return
+	}
+	if expiry := responseExpiry(s.Response.OCSPResponse); expiry.Before(end) {
+		end = expiry
+	}
+	start := s.NextUpdate
+	if start.Before(now) {
+		start = now
+	}
+	s.NextUpdate = start.Add(u.randFunc()(end.Sub(start)))
+	u.logger().Debug("first update spread", LogKeyTags, s.Tags, LogKeyNextFetch, s.NextUpdate)
+	u.fix(s)
+}
+
+// scheduleRetry schedules the next fetch after a failure, not before
+// retryAfter unless the cached response expires earlier.
+func (u *Updater) scheduleRetry(s *ocspStatus, retryAfter time.Time) {
+	s.failures++
+	now := u.Fetcher.now()
+	s.NextUpdate = now.Add(u.Backoff.delay(s.failures, u.tickRound(), u.randFunc()))
+	if retryAfter.After(s.NextUpdate) {
+		s.NextUpdate = retryAfter
+	}
+	if deadline := retryDeadline(s, now); !deadline.IsZero() && deadline.Before(s.NextUpdate) {
+		s.NextUpdate = deadline
+	}
+	u.logger().Debug("retry scheduled", LogKeyTags, s.Tags, LogKeyFailures, s.failures, LogKeyNextFetch, s.NextUpdate)
+	u.fix(s)
+}
+
+// postpone defers the fetch of s until the next probe of the open circuit c,
+// or until its cached response expires (or can no longer be used per
+// stale-if-error) if earlier, in which case it'll bypass the circuit.
+func (u *Updater) postpone(s *ocspStatus, c *circuit) {
+	s.NextUpdate, s.deferred, s.urgent = c.probeAt, true, false
+	if deadline := retryDeadline(s, u.Fetcher.now()); !deadline.IsZero() && deadline.Before(c.probeAt) {
+		s.NextUpdate, s.urgent = deadline, true
+	}
+	u.fix(s)
+}
+
+// retryDeadline returns the time the cached response of s expires, or can no
+// longer be used per stale-if-error if earlier, ignoring those already past;
+// it returns zero if both are past.
+func retryDeadline(s *ocspStatus, now time.Time) time.Time {
+	var deadline time.Time
+	if s.Response == nil || s.Response.OCSPResponse == nil {
+		return deadline
+	}
+	if expiry := responseExpiry(s.Response.OCSPResponse); expiry.After(now) {
+		deadline = expiry
+	}
+	if sie := s.Response.StaleIfError; sie.After(now) && (deadline.IsZero() || sie.Before(deadline)) {
+		deadline = sie
+	}
+	return deadline
+}
+
+func (u *Updater) randFunc() func(time.Duration) time.Duration {
+	if u.rand == nil {
+		return defaultRand
+	}
+	return u.rand
+}
+
+func (u *Updater) refreshPolicy() RefreshPolicy {
+	if u.RefreshPolicy == nil {
+		return DefaultRefreshPolicy
+	}
+	return u.RefreshPolicy
+}
+
+func (u *Updater) expiryWarning() time.Duration {
+	if u.ExpiryWarning > 0 {
+		return u.ExpiryWarning
+	}
+	return DefaultExpiryWarning
+}
+
+func (u *Updater) concurrency() int {
+	if u.Concurrency > 0 {
+		return u.Concurrency
 	}
+	return DefaultConcurrency
+}
+
+func (u *Updater) halfOpenInterval() time.Duration {
+	if u.CircuitBreaker.HalfOpenInterval > 0 {
+		return u.CircuitBreaker.HalfOpenInterval
+	}
+	return u.tickRound()
 }
 
 func (u *Updater) tickRound() time.Duration {
@@ -312,14 +1288,74 @@ func (u *Updater) tickRound() time.Duration {
 	return DefaultTickRound
 }
 
-func (u *Updater) log(format string, v ...interface{}) {
+func (u *Updater) metrics() Metrics {
+	if u.Metrics == nil {
+		return nopMetrics{}
+	}
+	return u.Metrics
+}
+
+func (u *Updater) logger() *slog.Logger {
+	if u.Logger != nil {
+		return u.Logger
+	}
 	if u.Log != nil {
-		u.Log(format, v...)
+		u.logFuncOnce.Do(func() {
+			u.logFuncLogger = slog.New(NewLogFuncHandler(u.Log))
+		})
+		return u.logFuncLogger
+	}
+	return discardLogger
+}
+
+// emit calls OnEvent with the event and the current tags of s, delivers
+// EventUpdated to DeliverUpdate or OnUpdate (unless withheld), and calls
+// OnRevoked for EventRevoked.
+func (u *Updater) emit(s *ocspStatus, event Event) {
+	// s.Tags is modified in place by AddOrUpdate and Remove
+	event.Tags = append([]string(nil), s.Tags...)
+	if u.OnEvent != nil {
+		u.call(s, u.OnEvent, event)
+	}
+	switch event.Type {
+	case EventUpdated:
+		if u.updateFunc() == nil {
+			break
+		}
+		if u.WithholdRevoked && event.Response != nil && event.Response.Status == ocsp.Revoked {
+			u.withhold(s)
+		} else {
+			u.deliver(s, event)
+		}
+	case EventRevoked:
+		if u.OnRevoked != nil {
+			u.call(s, u.OnRevoked, event)
+		}
 	}
 }
 
-func (u *Updater) onUpdate(event Event) {
-	if u.OnUpdate != nil {
-		go u.OnUpdate(event)
+// call asynchronously calls f, after the previous calls for the same status
+// returned, keeping track of the calls for Shutdown.
+func (u *Updater) call(s *ocspStatus, f func(Event), event Event) {
+	u.callbacks++
+	s.calls = append(s.calls, func() { f(event) })
+	if s.calling {
+		return
 	}
+	s.calling = true
+	go func() {
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		for len(s.calls) > 0 {
+			c := s.calls[0]
+			s.calls[0] = nil
+			s.calls = s.calls[1:]
+			u.mu.Unlock()
+			c()
+			u.mu.Lock()
+			u.callbacks--
+			u.checkIdle()
+		}
+		s.calling = false
+	}()
 }
@@ -0,0 +1,1241 @@
+package ocspd
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestRequestEqual(t *testing.T) {
+	body := []byte("ocsp request")
+	tests := []struct {
+		a, b     *Request
+		expected bool
+	}{
+		{
+			a:        &Request{endpoints: []endpoint{{url: "http://one/abc"}, {url: "http://two/abc"}}},
+			b:        &Request{endpoints: []endpoint{{url: "http://one/abc"}, {url: "http://two/abc"}}},
+			expected: true,
+		},
+		{
+			a: &Request{endpoints: []endpoint{{url: "http://one/abc"}, {url: "http://two/abc"}}},
+			b: &Request{endpoints: []endpoint{{url: "http://one/abc"}}},
+		},
+		{
+			a: &Request{endpoints: []endpoint{{url: "http://one/abc"}, {url: "http://two/abc"}}},
+			b: &Request{endpoints: []endpoint{{url: "http://two/abc"}, {url: "http://one/abc"}}},
+		},
+		{
+			a:        &Request{endpoints: []endpoint{{url: "http://one/", body: body}}},
+			b:        &Request{endpoints: []endpoint{{url: "http://one/", body: body}}, preferred: 1},
+			expected: true,
+		},
+		{
+			a: &Request{endpoints: []endpoint{{url: "http://one/", body: body}}},
+			b: &Request{endpoints: []endpoint{{url: "http://one/"}}},
+		},
+		{
+			a: &Request{endpoints: []endpoint{{url: "http://one/", body: body}}},
+			b: &Request{endpoints: []endpoint{{url: "http://one/", body: body}}, nonceLength: 32},
+		},
+	}
+	for i, test := range tests {
+		if eq := requestEqual(test.a, test.b); eq != test.expected {
+			t.Errorf("requestEqual #%d: got %v, want %v", i, eq, test.expected)
+		}
+		if eq := requestKey(test.a) == requestKey(test.b); eq != test.expected {
+			t.Errorf("requestKey #%d: got equal keys %v, want %v", i, eq, test.expected)
+		}
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestUpdaterRun(t *testing.T) {
+	fetching := make(chan struct{})
+	u := &Updater{
+		Fetcher: &Fetcher{
+			Client: &http.Client{
+				Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+					close(fetching)
+					<-r.Context().Done()
+					return nil, r.Context().Err()
+				}),
+			},
+		},
+	}
+	req := &Request{
+		endpoints: []endpoint{{url: "http://respo.nd/er/abc"}},
+		notAfter:  time.Now().Add(24 * time.Hour),
+	}
+	if err := u.AddOrUpdate("tag", req, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- u.Run(ctx)
+	}()
+
+	select {
+	case <-fetching:
+	case <-time.After(5 * time.Second):
+		t.Fatal("updater.Run: fetch not started")
+	}
+	if err := u.Run(context.Background()); err != errAlreadyRunning {
+		t.Errorf("updater.Run: error: got %v, want %v", err, errAlreadyRunning)
+	}
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("updater.Run: error: got %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("updater.Run: did not return after the context was cancelled")
+	}
+	if u.isStarted() {
+		t.Error("updater.Run: still started after returning")
+	}
+}
+
+func TestUpdaterRunHungResponder(t *testing.T) {
+	hung := make(chan struct{})
+	fetched := make(chan struct{})
+	u := &Updater{
+		Fetcher: &Fetcher{
+			Client: &http.Client{
+				Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+					if r.URL.Host == "hu.ng" {
+						close(hung)
+					} else {
+						close(fetched)
+					}
+					<-r.Context().Done()
+					return nil, r.Context().Err()
+				}),
+			},
+		},
+	}
+	if err := u.AddOrUpdate("hung", &Request{
+		endpoints: []endpoint{{url: "http://hu.ng/abc"}},
+		notAfter:  time.Now().Add(24 * time.Hour),
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- u.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	select {
+	case <-hung:
+	case <-time.After(5 * time.Second):
+		t.Fatal("updater.Run: fetch not started")
+	}
+	// due while the other fetch is still in flight
+	if err := u.AddOrUpdate("other", &Request{
+		endpoints: []endpoint{{url: "http://respo.nd/er/abc"}},
+		notAfter:  time.Now().Add(24 * time.Hour),
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-fetched:
+	case <-time.After(5 * time.Second):
+		t.Fatal("updater.Run: fetch blocked by a hung OCSP responder")
+	}
+}
+
+func TestUpdaterUpdateNowCancelled(t *testing.T) {
+	fetches := 0
+	u := &Updater{
+		Fetcher: &Fetcher{
+			Client: &http.Client{
+				Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+					fetches++
+					return nil, r.Context().Err()
+				}),
+			},
+		},
+	}
+	req := &Request{
+		endpoints: []endpoint{{url: "http://respo.nd/er/abc"}},
+		notAfter:  time.Now().Add(24 * time.Hour),
+	}
+	if err := u.AddOrUpdate("tag", req, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	u.UpdateNowContext(ctx)
+	if fetches != 0 {
+		t.Errorf("updater.UpdateNowContext: got %d fetches with a cancelled context, want 0", fetches)
+	}
+	if s := u.tagToStatus["tag"]; s.fetching || !s.NextUpdate.IsZero() {
+		t.Errorf("updater.UpdateNowContext: got fetching %v and next update %v, want an untouched status", s.fetching, s.NextUpdate)
+	}
+}
+
+func TestUpdaterBackoff(t *testing.T) {
+	now := time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)
+	status := http.StatusInternalServerError
+	var logs []string
+	u := &Updater{
+		Backoff: Backoff{
+			Initial:    time.Minute,
+			Max:        10 * time.Minute,
+			Multiplier: 3,
+			Jitter:     0.5,
+		},
+		CircuitBreaker: CircuitBreaker{Threshold: -1},
+		Log: func(format string, v ...interface{}) {
+			logs = append(logs, fmt.Sprintf(format, v...))
+		},
+		Fetcher: &Fetcher{
+			Client: &http.Client{
+				Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+					return &http.Response{
+						StatusCode: status,
+						Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+					}, nil
+				}),
+			},
+			time: func() time.Time { return now },
+		},
+		rand: func(d time.Duration) time.Duration { return d / 2 },
+	}
+	req := &Request{
+		endpoints: []endpoint{{url: "http://respo.nd/er/abc"}},
+		notAfter:  now.Add(24 * time.Hour),
+	}
+	if err := u.AddOrUpdate("tag", req, nil); err != nil {
+		t.Fatal(err)
+	}
+	s := u.tagToStatus["tag"]
+
+	// delays are 1m, 3m, 9m, then capped at 10m, with 25% jitter removed
+	for i, expected := range []time.Duration{
+		45 * time.Second,
+		135 * time.Second,
+		405 * time.Second,
+		450 * time.Second,
+		450 * time.Second,
+	} {
+		logs = nil
+		u.UpdateNow()
+		if next := s.NextUpdate.Sub(now); next != expected {
+			t.Errorf("updater.UpdateNow #%d: next update in %v, want %v", i, next, expected)
+		}
+		if expected := fmt.Sprintf("retry scheduled tags=tag failures=%d next_fetch=%s\n", i+1, s.NextUpdate.Format(time.RFC3339)); logs[len(logs)-1] != expected {
+			t.Errorf("updater.UpdateNow #%d: logged %q, want %q", i, logs[len(logs)-1], expected)
+		}
+		now = s.NextUpdate
+	}
+
+	// success resets the backoff
+	status = http.StatusNotModified
+	u.UpdateNow()
+	if s.failures != 0 {
+		t.Errorf("updater.UpdateNow: got %d failures after success, want 0", s.failures)
+	}
+	status = http.StatusInternalServerError
+	s.NextUpdate = time.Time{}
+	u.UpdateNow()
+	if next, expected := s.NextUpdate.Sub(now), 45*time.Second; next != expected {
+		t.Errorf("updater.UpdateNow: next update in %v after reset, want %v", next, expected)
+	}
+
+	// retries are never scheduled after the cached response expires
+	s.Response = &Response{OCSPResponse: &ocsp.Response{NextUpdate: now.Add(time.Minute)}}
+	s.NextUpdate = time.Time{}
+	u.UpdateNow()
+	if next, expected := s.NextUpdate.Sub(now), time.Minute; next != expected {
+		t.Errorf("updater.UpdateNow: next update in %v with cached response, want %v", next, expected)
+	}
+
+	// nor after the cached response can no longer be used per stale-if-error,
+	// and failures within that window are expected
+	s.Response = &Response{
+		OCSPResponse: &ocsp.Response{NextUpdate: now.Add(24 * time.Hour)},
+		StaleIfError: now.Add(30 * time.Second),
+	}
+	s.NextUpdate = time.Time{}
+	logs = nil
+	u.UpdateNow()
+	if next, expected := s.NextUpdate.Sub(now), 30*time.Second; next != expected {
+		t.Errorf("updater.UpdateNow: next update in %v with stale-if-error, want %v", next, expected)
+	}
+	if expected := "error while fetching OCSP response, serving cached one as allowed by stale-if-error "; !strings.HasPrefix(logs[1], expected) {
+		t.Errorf("updater.UpdateNow: logged %q, want prefix %q", logs[1], expected)
+	}
+	now = s.NextUpdate
+	logs = nil
+	u.UpdateNow()
+	if expected := "error while fetching OCSP response "; !strings.HasPrefix(logs[1], expected) {
+		t.Errorf("updater.UpdateNow: logged %q after stale-if-error, want prefix %q", logs[1], expected)
+	}
+}
+
+func TestUpdaterCircuitBreaker(t *testing.T) {
+	now := time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)
+	status := http.StatusInternalServerError
+	fetches := make(map[string]int)
+	var logs []string
+	u := &Updater{
+		Backoff:     Backoff{Initial: time.Minute},
+		Concurrency: 1,
+		TickRound:   time.Minute,
+		CircuitBreaker: CircuitBreaker{
+			Threshold:        2,
+			HalfOpenInterval: 10 * time.Minute,
+		},
+		Log: func(format string, v ...interface{}) {
+			logs = append(logs, fmt.Sprintf(format, v...))
+		},
+		Fetcher: &Fetcher{
+			Client: &http.Client{
+				Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+					fetches[r.URL.Host]++
+					resp := &http.Response{
+						StatusCode: status,
+						Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+					}
+					if r.URL.Host == "other" {
+						resp.StatusCode = http.StatusNotModified
+					}
+					return resp, nil
+				}),
+			},
+			time: func() time.Time { return now },
+		},
+	}
+	for _, tag := range []string{"a", "b", "c", "d"} {
+		req := &Request{
+			endpoints: []endpoint{{url: "http://failing/" + tag}},
+			notAfter:  now.Add(24 * time.Hour),
+		}
+		if err := u.AddOrUpdate(tag, req, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := u.AddOrUpdate("other", &Request{
+		endpoints: []endpoint{{url: "http://other/abc"}},
+		notAfter:  now.Add(24 * time.Hour),
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	countLogs := func(prefix string) (n int) {
+		for _, l := range logs {
+			if strings.HasPrefix(l, prefix) {
+				n++
+			}
+		}
+		return n
+	}
+
+	// the circuit opens after 2 failures, postponing the other requests
+	u.UpdateNow()
+	if fetches["failing"] != 2 || fetches["other"] != 1 {
+		t.Errorf("updater.UpdateNow: fetches: got %v, want 2 to failing and 1 to other", fetches)
+	}
+	if n := countLogs("postponed OCSP requests to failing responder responder=failing count=2 "); n != 1 {
+		t.Errorf("updater.UpdateNow: got %d consolidated log lines, want 1; logs: %q", n, logs)
+	}
+
+	// retries are postponed too
+	now = now.Add(time.Minute)
+	u.UpdateNow()
+	if fetches["failing"] != 2 || fetches["other"] != 2 {
+		t.Errorf("updater.UpdateNow: fetches: got %v, want 2 to failing and 2 to other", fetches)
+	}
+
+	// a single probe is sent once per half-open interval
+	now = now.Add(9 * time.Minute)
+	logs = nil
+	u.UpdateNow()
+	if fetches["failing"] != 3 {
+		t.Errorf("updater.UpdateNow: fetches: got %v, want 3 to failing", fetches)
+	}
+	if n := countLogs("postponed OCSP requests to failing responder responder=failing count=3 "); n != 1 {
+		t.Errorf("updater.UpdateNow: got %d consolidated log lines, want 1; logs: %q", n, logs)
+	}
+	for _, s := range u.statuses {
+		if s.Tags[0] != "other" && !s.NextUpdate.Equal(now.Add(10*time.Minute)) {
+			t.Errorf("updater.UpdateNow: %s next update: got %v, want %v", s.Tags[0], s.NextUpdate, now.Add(10*time.Minute))
+		}
+	}
+
+	// a successful probe closes the circuit and resumes the postponed requests
+	status = http.StatusNotModified
+	now = now.Add(10 * time.Minute)
+	u.UpdateNow()
+	if fetches["failing"] != 7 {
+		t.Errorf("updater.UpdateNow: fetches: got %v, want 7 to failing", fetches)
+	}
+	if len(u.circuits) != 0 {
+		t.Errorf("updater.UpdateNow: got circuits %v, want none", u.circuits)
+	}
+	for _, s := range u.statuses {
+		if s.failures != 0 || s.deferred {
+			t.Errorf("updater.UpdateNow: %s: got %d failures (deferred: %v), want 0", s.Tags[0], s.failures, s.deferred)
+		}
+	}
+}
+
+func TestUpdaterRetryAfter(t *testing.T) {
+	for _, threshold := range []int{0, -1} {
+		now := time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)
+		fetches := 0
+		u := &Updater{
+			CircuitBreaker: CircuitBreaker{Threshold: threshold},
+			Concurrency:    1,
+			Fetcher: &Fetcher{
+				Client: &http.Client{
+					Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+						fetches++
+						return &http.Response{
+							StatusCode: http.StatusServiceUnavailable,
+							Header:     http.Header{"Retry-After": {"3600"}},
+							Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+						}, nil
+					}),
+				},
+				time: func() time.Time { return now },
+			},
+		}
+		for _, tag := range []string{"a", "b"} {
+			req := &Request{
+				endpoints: []endpoint{{url: "http://respo.nd/er/" + tag}},
+				notAfter:  now.Add(24 * time.Hour),
+			}
+			if err := u.AddOrUpdate(tag, req, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		u.UpdateNow()
+		// with a circuit breaker, the whole responder is postponed
+		expectedFetches := 1
+		if threshold < 0 {
+			expectedFetches = 2
+		}
+		if fetches != expectedFetches {
+			t.Errorf("updater.UpdateNow (threshold %d): got %d fetches, want %d", threshold, fetches, expectedFetches)
+		}
+		for _, s := range u.statuses {
+			if expected := now.Add(time.Hour); !s.NextUpdate.Equal(expected) {
+				t.Errorf("updater.UpdateNow (threshold %d): %s next update: got %v, want %v", threshold, s.Tags[0], s.NextUpdate, expected)
+			}
+		}
+	}
+}
+
+func TestUpdaterRetryAfterCapped(t *testing.T) {
+	start := time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	fetches := 0
+	u := &Updater{
+		Backoff:     Backoff{Max: 2 * time.Hour},
+		Concurrency: 1,
+		Fetcher: &Fetcher{
+			Client: &http.Client{
+				Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+					fetches++
+					return &http.Response{
+						StatusCode: http.StatusServiceUnavailable,
+						Header:     http.Header{"Retry-After": {"31536000"}},
+						Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+					}, nil
+				}),
+			},
+			time: func() time.Time { return now },
+		},
+	}
+	for _, tag := range []string{"a", "b"} {
+		req := &Request{
+			endpoints: []endpoint{{url: "http://respo.nd/er/" + tag}},
+			notAfter:  now.Add(24 * time.Hour),
+		}
+		if err := u.AddOrUpdate(tag, req, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, b := u.tagToStatus["a"], u.tagToStatus["b"]
+	a.Response = &Response{OCSPResponse: &ocsp.Response{ThisUpdate: now.Add(-time.Hour), NextUpdate: now.Add(3 * time.Hour)}}
+	b.Response = &Response{OCSPResponse: &ocsp.Response{ThisUpdate: now.Add(-time.Hour), NextUpdate: now.Add(30 * time.Minute)}}
+
+	// the Retry-After is capped at Backoff.Max, and never postpones fetches
+	// after the cached responses expire
+	u.UpdateNow()
+	if fetches != 1 {
+		t.Errorf("updater.UpdateNow: got %d fetches, want 1", fetches)
+	}
+	if expected := start.Add(2 * time.Hour); !a.NextUpdate.Equal(expected) {
+		t.Errorf("updater.UpdateNow: a next update: got %v, want %v", a.NextUpdate, expected)
+	}
+	if expected := start.Add(30 * time.Minute); !b.NextUpdate.Equal(expected) {
+		t.Errorf("updater.UpdateNow: b next update: got %v, want %v", b.NextUpdate, expected)
+	}
+
+	// the expiring response is fetched despite the open circuit
+	now = start.Add(30 * time.Minute)
+	u.UpdateNow()
+	if fetches != 2 {
+		t.Errorf("updater.UpdateNow: got %d fetches before the cached response expires, want 2", fetches)
+	}
+	if expected := now.Add(2 * time.Hour); !b.NextUpdate.Equal(expected) {
+		t.Errorf("updater.UpdateNow: b next update: got %v, want %v", b.NextUpdate, expected)
+	}
+	if !a.NextUpdate.Before(b.NextUpdate) {
+		t.Errorf("updater.UpdateNow: a next update: got %v, want before %v", a.NextUpdate, b.NextUpdate)
+	}
+}
+
+func TestUpdaterConcurrency(t *testing.T) {
+	var mu sync.Mutex
+	var inflight, maxInflight int
+	perHost := make(map[string]int)
+	maxPerHost := make(map[string]int)
+	release := make(chan struct{})
+	released := false
+	u := &Updater{
+		Concurrency:        4,
+		ConcurrencyPerHost: 2,
+		Fetcher: &Fetcher{
+			Client: &http.Client{
+				Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+					mu.Lock()
+					inflight++
+					perHost[r.URL.Host]++
+					if inflight > maxInflight {
+						maxInflight = inflight
+					}
+					if perHost[r.URL.Host] > maxPerHost[r.URL.Host] {
+						maxPerHost[r.URL.Host] = perHost[r.URL.Host]
+					}
+					if inflight == 4 && !released {
+						released = true
+						close(release)
+					}
+					mu.Unlock()
+
+					select {
+					case <-release:
+					case <-time.After(5 * time.Second):
+					}
+
+					mu.Lock()
+					inflight--
+					perHost[r.URL.Host]--
+					mu.Unlock()
+					return &http.Response{
+						StatusCode: http.StatusNotModified,
+						Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+					}, nil
+				}),
+			},
+		},
+	}
+	for _, tag := range []string{"a1", "a2", "a3", "b1", "b2", "b3"} {
+		req := &Request{
+			endpoints: []endpoint{{url: "http://" + tag[:1] + "/" + tag}},
+			notAfter:  time.Now().Add(24 * time.Hour),
+		}
+		if err := u.AddOrUpdate(tag, req, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	u.UpdateNow()
+	if maxInflight != 4 {
+		t.Errorf("updater.UpdateNow: got at most %d concurrent fetches, want 4", maxInflight)
+	}
+	for host, n := range maxPerHost {
+		if n > 2 {
+			t.Errorf("updater.UpdateNow: got %d concurrent fetches to %s, want at most 2", n, host)
+		}
+	}
+	for _, s := range u.statuses {
+		if s.fetching {
+			t.Errorf("updater.UpdateNow: %s still fetching", s.Tags[0])
+		}
+	}
+}
+
+func TestUpdaterRemoveWhileFetching(t *testing.T) {
+	var u *Updater
+	var logs []string
+	u = &Updater{
+		Log: func(format string, v ...interface{}) {
+			logs = append(logs, fmt.Sprintf(format, v...))
+		},
+		Fetcher: &Fetcher{
+			Client: &http.Client{
+				Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+					u.Remove("tag")
+					return &http.Response{
+						StatusCode: http.StatusInternalServerError,
+						Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+					}, nil
+				}),
+			},
+		},
+	}
+	req := &Request{
+		endpoints: []endpoint{{url: "http://respo.nd/er/abc"}},
+		notAfter:  time.Now().Add(24 * time.Hour),
+	}
+	if err := u.AddOrUpdate("tag", req, nil); err != nil {
+		t.Fatal(err)
+	}
+	s := u.tagToStatus["tag"]
+
+	u.UpdateNow()
+	if len(u.statuses) != 0 || len(u.tagToStatus) != 0 {
+		t.Errorf("updater.UpdateNow: got statuses %v, want none", u.statuses)
+	}
+	if s.failures != 0 || len(u.circuits) != 0 {
+		t.Errorf("updater.UpdateNow: got %d failures and circuits %v, want none", s.failures, u.circuits)
+	}
+	if expected := "discarding OCSP response: certificate no longer monitored tags=tag\n"; logs[len(logs)-1] != expected {
+		t.Errorf("updater.UpdateNow: logged %q, want %q", logs[len(logs)-1], expected)
+	}
+}
+
+func benchmarkRequests(n int) []*Request {
+	notAfter := time.Now().Add(24 * time.Hour)
+	reqs := make([]*Request, n)
+	for i := range reqs {
+		reqs[i] = &Request{
+			endpoints: []endpoint{{url: fmt.Sprintf("http://respo.nd/er/%d", i)}},
+			notAfter:  notAfter,
+		}
+	}
+	return reqs
+}
+
+func benchmarkUpdater() *Updater {
+	return &Updater{
+		// resetTimer is a no-op until started
+		timer: time.NewTimer(math.MaxInt64),
+	}
+}
+
+func BenchmarkUpdaterAddOrUpdate(b *testing.B) {
+	reqs := benchmarkRequests(50000)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		u := benchmarkUpdater()
+		for i, req := range reqs {
+			if err := u.AddOrUpdate(strconv.Itoa(i), req, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+		u.timer.Stop()
+	}
+}
+
+func BenchmarkUpdaterReschedule(b *testing.B) {
+	reqs := benchmarkRequests(50000)
+	u := benchmarkUpdater()
+	defer u.timer.Stop()
+	for i, req := range reqs {
+		if err := u.AddOrUpdate(strconv.Itoa(i), req, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+	now := time.Now()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		i := n % len(reqs)
+		resp := &Response{MaxAge: now.Add(time.Duration(rand.Int63n(int64(24 * time.Hour))))}
+		if err := u.AddOrUpdate(strconv.Itoa(i), reqs[i], resp); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUpdaterRemove(b *testing.B) {
+	reqs := benchmarkRequests(50000)
+	for n := 0; n < b.N; n++ {
+		b.StopTimer()
+		u := benchmarkUpdater()
+		for i, req := range reqs {
+			if err := u.AddOrUpdate(strconv.Itoa(i), req, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.StartTimer()
+		for i := range reqs {
+			u.Remove(strconv.Itoa(i))
+		}
+		u.timer.Stop()
+	}
+}
+
+func TestUpdaterRefreshPolicy(t *testing.T) {
+	now := time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)
+	resp := &Response{
+		OCSPResponse: &ocsp.Response{
+			ThisUpdate: now.Add(-time.Hour),
+			NextUpdate: now.Add(8*24*time.Hour - time.Hour),
+		},
+	}
+	for i, tt := range []struct {
+		policy   RefreshPolicy
+		expected time.Time
+	}{
+		// halfway through the validity period, plus a quarter of the
+		// remaining half
+		{nil, now.Add(5*24*time.Hour - time.Hour)},
+		// other policies are honored exactly
+		{MinRemainingRefreshPolicy{MinRemaining: 24 * time.Hour}, now.Add(7*24*time.Hour - time.Hour)},
+		{FractionsRefreshPolicy{Fractions: []float64{0.5, 0.75}}, now.Add(4*24*time.Hour - time.Hour)},
+	} {
+		u := &Updater{
+			TickRound:     time.Minute,
+			RefreshPolicy: tt.policy,
+			Fetcher: &Fetcher{
+				time: func() time.Time { return now },
+			},
+			rand: func(d time.Duration) time.Duration { return d / 2 },
+		}
+		req := &Request{
+			endpoints: []endpoint{{url: "http://respo.nd/er/abc"}},
+			notAfter:  now.Add(30 * 24 * time.Hour),
+		}
+		if err := u.AddOrUpdate("tag", req, resp); err != nil {
+			t.Fatal(err)
+		}
+		if next := u.tagToStatus["tag"].NextUpdate; !next.Equal(tt.expected) {
+			t.Errorf("updater.AddOrUpdate #%d: next update: got %v, want %v", i, next, tt.expected)
+		}
+		if needs := needsRefresh(resp.OCSPResponse, now, 0, tt.policy, tt.expected); !needs {
+			t.Errorf("needsRefresh #%d: got false at the scheduled refresh, want true", i)
+		}
+	}
+}
+
+func TestUpdaterStaleWhileRevalidate(t *testing.T) {
+	now := time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)
+	u := &Updater{
+		Fetcher: &Fetcher{
+			time: func() time.Time { return now },
+		},
+		rand: func(d time.Duration) time.Duration { return d / 2 },
+	}
+	for i, tt := range []struct {
+		resp     *Response
+		expected time.Time
+	}{
+		{&Response{OCSPResponse: &ocsp.Response{ThisUpdate: now, NextUpdate: now.Add(72 * time.Hour)}, MaxAge: now.Add(2 * time.Hour)}, now.Add(2 * time.Hour)},
+		// spread within the stale-while-revalidate window
+		{&Response{OCSPResponse: &ocsp.Response{ThisUpdate: now, NextUpdate: now.Add(72 * time.Hour)}, MaxAge: now.Add(2 * time.Hour), StaleWhileRevalidate: now.Add(4 * time.Hour)}, now.Add(3 * time.Hour)},
+		// but before the response expires
+		{&Response{OCSPResponse: &ocsp.Response{ThisUpdate: now, NextUpdate: now.Add(3 * time.Hour)}, MaxAge: now.Add(time.Hour), StaleWhileRevalidate: now.Add(10 * time.Hour)}, now.Add(2 * time.Hour)},
+	} {
+		tag := strconv.Itoa(i)
+		if err := u.AddOrUpdate(tag, &Request{
+			endpoints: []endpoint{{url: "http://respo.nd/er/" + tag}},
+			notAfter:  now.Add(30 * 24 * time.Hour),
+		}, tt.resp); err != nil {
+			t.Fatal(err)
+		}
+		if next := u.tagToStatus[tag].NextUpdate; !next.Equal(tt.expected) {
+			t.Errorf("updater.AddOrUpdate #%d: next update at %v, want %v", i, next, tt.expected)
+		}
+	}
+}
+
+func TestUpdaterStaleMaxAge(t *testing.T) {
+	ocspResponse, _ := hex.DecodeString(ocspResponseHex)
+	parsedOCSPResponse, err := ocsp.ParseResponse(ocspResponse, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuerCert, _ := hex.DecodeString(startComHex)
+	issuer, err := x509.ParseCertificate(issuerCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := parsedOCSPResponse.ThisUpdate.Add(parsedOCSPResponse.NextUpdate.Sub(parsedOCSPResponse.ThisUpdate) / 2)
+
+	fetches := 0
+	u := &Updater{
+		TickRound: time.Minute,
+		Fetcher: &Fetcher{
+			Client: &http.Client{
+				Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+					fetches++
+					// served by a cache for longer than its max-age
+					return &http.Response{
+						StatusCode: http.StatusOK,
+						Header: http.Header{
+							"Content-Type":  {"application/ocsp-response"},
+							"Cache-Control": {"max-age=3600"},
+							"Age":           {"7200"},
+						},
+						ContentLength: int64(len(ocspResponse)),
+						Body:          ioutil.NopCloser(bytes.NewReader(ocspResponse)),
+					}, nil
+				}),
+			},
+			time: func() time.Time { return now },
+		},
+	}
+	req := &Request{
+		endpoints: []endpoint{{url: "http://respo.nd/er/" + ocspRequestBase64}},
+		notAfter:  now.Add(24 * time.Hour),
+		issuer:    issuer,
+	}
+	if err := u.AddOrUpdate("tag", req, nil); err != nil {
+		t.Fatal(err)
+	}
+	s := u.tagToStatus["tag"]
+
+	for i := 0; i < 5; i++ {
+		u.UpdateNow()
+	}
+	if fetches != 1 {
+		t.Errorf("updater.UpdateNow: got %d fetches, want 1", fetches)
+	}
+	if expected := now.Add(time.Minute); !s.NextUpdate.Equal(expected) {
+		t.Errorf("updater.UpdateNow: next update at %v, want %v", s.NextUpdate, expected)
+	}
+}
+
+func TestUpdaterNotModified(t *testing.T) {
+	now := time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		name       string
+		header     http.Header
+		nextUpdate time.Time
+		requests   int
+		expected   time.Time
+	}{
+		// the 304 makes the cached response fresh again
+		{"max-age", http.Header{"Cache-Control": {"max-age=3600"}}, now.Add(48 * time.Hour), 1, now.Add(time.Hour)},
+		// the cached response is expired: refreshed asap (bypassing caches),
+		// but not over and over again
+		{"expired", nil, now.Add(-time.Hour), 2, now.Add(time.Minute)},
+	} {
+		requests := 0
+		u := &Updater{
+			TickRound: time.Minute,
+			Fetcher: &Fetcher{
+				Client: &http.Client{
+					Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+						requests++
+						return &http.Response{
+							StatusCode: http.StatusNotModified,
+							Header:     tt.header,
+							Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+						}, nil
+					}),
+				},
+				time: func() time.Time { return now },
+			},
+		}
+		req := &Request{
+			endpoints: []endpoint{{url: "http://respo.nd/er/abc"}},
+			notAfter:  now.Add(72 * time.Hour),
+		}
+		// stale, per its max-age
+		if err := u.AddOrUpdate("tag", req, &Response{
+			OCSPResponse: &ocsp.Response{
+				Status:     ocsp.Good,
+				ThisUpdate: now.Add(-48 * time.Hour),
+				NextUpdate: tt.nextUpdate,
+			},
+			MaxAge: now.Add(-time.Minute),
+			Etag:   `"etag"`,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		s := u.tagToStatus["tag"]
+		s.NextUpdate = time.Time{}
+		u.fix(s)
+
+		for i := 0; i < 5; i++ {
+			u.UpdateNow()
+		}
+		if requests != tt.requests {
+			t.Errorf("updater.UpdateNow (%s): got %d requests, want %d", tt.name, requests, tt.requests)
+		}
+		if !s.NextUpdate.Equal(tt.expected) {
+			t.Errorf("updater.UpdateNow (%s): next update at %v, want %v", tt.name, s.NextUpdate, tt.expected)
+		}
+		if (tt.header != nil && !s.Response.MaxAge.Equal(tt.expected)) || s.Response.Etag != `"etag"` {
+			t.Errorf("updater.UpdateNow (%s): got max-age %v and etag %q", tt.name, s.Response.MaxAge, s.Response.Etag)
+		}
+	}
+}
+
+func TestUpdaterEvents(t *testing.T) {
+	ocspResponse, _ := hex.DecodeString(ocspResponseHex)
+	parsedOCSPResponse, err := ocsp.ParseResponse(ocspResponse, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuerCert, _ := hex.DecodeString(startComHex)
+	issuer, err := x509.ParseCertificate(issuerCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := parsedOCSPResponse.ThisUpdate.Add(parsedOCSPResponse.NextUpdate.Sub(parsedOCSPResponse.ThisUpdate) / 2)
+
+	status := http.StatusInternalServerError
+	events := make(chan Event, 10)
+	updates := make(chan Event, 10)
+	u := &Updater{
+		OnEvent:  func(ev Event) { events <- ev },
+		OnUpdate: func(ev Event) { updates <- ev },
+		Fetcher: &Fetcher{
+			Client: &http.Client{
+				Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+					resp := &http.Response{
+						StatusCode: status,
+						Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+					}
+					if status == http.StatusOK {
+						resp.Header = http.Header{"Content-Type": {"application/ocsp-response"}}
+						resp.ContentLength = int64(len(ocspResponse))
+						resp.Body = ioutil.NopCloser(bytes.NewReader(ocspResponse))
+					}
+					return resp, nil
+				}),
+			},
+			time: func() time.Time { return now },
+		},
+	}
+	req := &Request{
+		endpoints: []endpoint{{url: "http://respo.nd/er/" + ocspRequestBase64}},
+		notAfter:  now.Add(24 * time.Hour),
+		issuer:    issuer,
+	}
+	// an expired response, to be refreshed asap
+	prev := &Response{
+		OCSPResponse: &ocsp.Response{
+			Status:     ocsp.Unknown,
+			ThisUpdate: now.Add(-48 * time.Hour),
+			NextUpdate: now.Add(-time.Hour),
+		},
+	}
+	if err := u.AddOrUpdate("tag", req, prev); err != nil {
+		t.Fatal(err)
+	}
+	s := u.tagToStatus["tag"]
+
+	receive := func(n int) []Event {
+		var evs []Event
+		for i := 0; i < n; i++ {
+			select {
+			case ev := <-events:
+				evs = append(evs, ev)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("updater.UpdateNow: got %d events, want %d", len(evs), n)
+			}
+		}
+		return evs
+	}
+	refresh := func() {
+		s.NextUpdate = time.Time{}
+		u.fix(s)
+		u.UpdateNow()
+	}
+
+	u.UpdateNow()
+	evs := receive(2)
+	if evs[0].Type != EventFetchError || evs[0].Previous != prev || evs[0].Failures != 1 || evs[0].Err == nil {
+		t.Errorf("updater.UpdateNow: got %+v, want fetch error event", evs[0])
+	}
+	if evs[1].Type != EventExpiring || evs[1].Response != prev.OCSPResponse {
+		t.Errorf("updater.UpdateNow: got %+v, want expiring event", evs[1])
+	}
+
+	status = http.StatusNotModified
+	refresh()
+	evs = receive(1)
+	if evs[0].Type != EventNotModified || evs[0].Previous != prev || evs[0].Response != prev.OCSPResponse {
+		t.Errorf("updater.UpdateNow: got %+v, want not modified event", evs[0])
+	}
+
+	status = http.StatusOK
+	refresh()
+	evs = receive(2)
+	for i, expected := range []EventType{EventUpdated, EventStatusChanged} {
+		if evs[i].Type != expected || evs[i].Previous.OCSPResponse != prev.OCSPResponse || evs[i].Response.Status != ocsp.Good {
+			t.Errorf("updater.UpdateNow: got %+v, want %v event", evs[i], expected)
+		}
+	}
+
+	select {
+	case ev := <-updates:
+		if ev.Type != EventUpdated {
+			t.Errorf("updater.OnUpdate: got %v event, want %v", ev.Type, EventUpdated)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("updater.OnUpdate: not called")
+	}
+	select {
+	case ev := <-updates:
+		t.Errorf("updater.OnUpdate: unexpected %v event", ev.Type)
+	default:
+	}
+}
+
+func TestUpdaterRevoked(t *testing.T) {
+	now := time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)
+	for _, withhold := range []bool{false, true} {
+		updates := make(chan Event, 10)
+		revoked := make(chan Event, 10)
+		events := make(chan EventType, 10)
+		u := &Updater{
+			OnUpdate:  func(ev Event) { updates <- ev },
+			OnRevoked: func(ev Event) { revoked <- ev },
+			OnEvent: func(ev Event) {
+				// let later events overtake this one if they could
+				time.Sleep(time.Millisecond)
+				events <- ev.Type
+			},
+			WithholdRevoked: withhold,
+			Fetcher: &Fetcher{
+				time: func() time.Time { return now },
+			},
+		}
+		req := &Request{
+			endpoints: []endpoint{{url: "http://respo.nd/er/abc"}},
+			notAfter:  now.Add(24 * time.Hour),
+		}
+		if err := u.AddOrUpdate("tag", req, nil); err != nil {
+			t.Fatal(err)
+		}
+		s := u.tagToStatus["tag"]
+		s.Response = &Response{
+			OCSPResponse: &ocsp.Response{
+				Status:     ocsp.Good,
+				ThisUpdate: now.Add(-time.Hour),
+				NextUpdate: now.Add(24 * time.Hour),
+			},
+		}
+		r := &Response{
+			OCSPResponse: &ocsp.Response{
+				Status:     ocsp.Revoked,
+				ThisUpdate: now,
+				NextUpdate: now.Add(24 * time.Hour),
+			},
+		}
+		u.mu.Lock()
+		u.fetched(context.Background(), s, s.responder, []string{"tag"}, r, nil)
+		u.mu.Unlock()
+
+		select {
+		case ev := <-revoked:
+			if ev.Type != EventRevoked || ev.Response != r.OCSPResponse {
+				t.Errorf("updater.OnRevoked (withhold %v): got %+v, want revoked event", withhold, ev)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("updater.OnRevoked (withhold %v): not called", withhold)
+		}
+		if withhold {
+			select {
+			case ev := <-updates:
+				t.Errorf("updater.OnUpdate (withhold %v): unexpected %v event", withhold, ev.Type)
+			case <-time.After(10 * time.Millisecond):
+			}
+		} else {
+			select {
+			case <-updates:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("updater.OnUpdate (withhold %v): not called", withhold)
+			}
+		}
+		var types []EventType
+		for len(types) < 3 {
+			select {
+			case typ := <-events:
+				types = append(types, typ)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("updater.OnEvent (withhold %v): got events %v, want 3", withhold, types)
+			}
+		}
+		if expected := []EventType{EventUpdated, EventStatusChanged, EventRevoked}; !reflect.DeepEqual(types, expected) {
+			t.Errorf("updater.OnEvent (withhold %v): got events %v, want %v", withhold, types, expected)
+		}
+	}
+}
+
+func TestUpdaterEventTags(t *testing.T) {
+	now := time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)
+	block := make(chan struct{})
+	events := make(chan Event, 10)
+	u := &Updater{
+		OnEvent: func(ev Event) {
+			<-block
+			events <- ev
+		},
+		Fetcher: &Fetcher{
+			time: func() time.Time { return now },
+		},
+	}
+	req := &Request{
+		endpoints: []endpoint{{url: "http://respo.nd/er/abc"}},
+		notAfter:  now.Add(24 * time.Hour),
+	}
+	for _, tag := range []string{"a", "c"} {
+		if err := u.AddOrUpdate(tag, req, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := u.tagToStatus["a"]
+	u.mu.Lock()
+	u.fetched(context.Background(), s, s.responder, []string{"a", "c"}, nil, errors.New("failed"))
+	u.mu.Unlock()
+
+	// the callback runs concurrently with changes to the tags
+	u.Remove("a")
+	if err := u.AddOrUpdate("b", req, nil); err != nil {
+		t.Fatal(err)
+	}
+	close(block)
+	select {
+	case ev := <-events:
+		if ev.Type != EventFetchError || !reflect.DeepEqual(ev.Tags, []string{"a", "c"}) {
+			t.Errorf("updater.OnEvent: got %v event with tags %v, want fetch error event with tags [a c]", ev.Type, ev.Tags)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("updater.OnEvent: not called")
+	}
+}
+
+func TestUpdaterCertExpiry(t *testing.T) {
+	now := time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)
+	var fetches int
+	events := make(chan Event, 10)
+	u := &Updater{
+		CertExpiryWarning: 3 * time.Hour,
+		OnEvent:           func(ev Event) { events <- ev },
+		Fetcher: &Fetcher{
+			Client: &http.Client{
+				Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+					fetches++
+					return &http.Response{
+						StatusCode: http.StatusNotModified,
+						Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+					}, nil
+				}),
+			},
+			time: func() time.Time { return now },
+		},
+	}
+	req := &Request{
+		endpoints: []endpoint{{url: "http://respo.nd/er/abc"}},
+		notAfter:  now.Add(2 * time.Hour),
+	}
+	if err := u.AddOrUpdate("tag", req, nil); err != nil {
+		t.Fatal(err)
+	}
+	receive := func() (types []EventType) {
+		for {
+			select {
+			case ev := <-events:
+				if ev.Type == EventCertExpiring || ev.Type == EventCertExpired {
+					if !ev.NotAfter.Equal(req.notAfter) {
+						t.Errorf("updater.OnEvent: got NotAfter %v, want %v", ev.NotAfter, req.notAfter)
+					}
+				}
+				types = append(types, ev.Type)
+			case <-time.After(50 * time.Millisecond):
+				sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+				return types
+			}
+		}
+	}
+
+	u.UpdateNow()
+	if types, expected := receive(), []EventType{EventNotModified, EventCertExpiring}; !reflect.DeepEqual(types, expected) {
+		t.Errorf("updater.UpdateNow: got events %v, want %v", types, expected)
+	}
+
+	now = now.Add(3 * time.Hour)
+	u.UpdateNow()
+	if types, expected := receive(), []EventType{EventCertExpired}; !reflect.DeepEqual(types, expected) {
+		t.Errorf("updater.UpdateNow: got events %v, want %v", types, expected)
+	}
+	u.UpdateNow()
+	if types := receive(); len(types) != 0 {
+		t.Errorf("updater.UpdateNow: got events %v after expiry, want none", types)
+	}
+	if fetches != 1 {
+		t.Errorf("updater.UpdateNow: got %d fetches, want 1", fetches)
+	}
+	if s := u.Snapshot()[0]; !s.CertExpired || !s.NextFetch.Equal(never) {
+		t.Errorf("updater.Snapshot: got %+v, want an expired certificate", s)
+	}
+}
+
+func TestUpdaterStartupSpread(t *testing.T) {
+	now := time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)
+	u := &Updater{
+		StartupSpread: time.Hour,
+		TickRound:     time.Nanosecond,
+		RefreshPolicy: MinRemainingRefreshPolicy{MinRemaining: 48 * time.Hour, RetryInterval: time.Minute},
+		Fetcher:       &Fetcher{time: func() time.Time { return now }},
+		rand:          func(d time.Duration) time.Duration { return d / 2 },
+	}
+	for i, tt := range []struct {
+		resp     *Response
+		expected time.Time
+	}{
+		// no cached response
+		{nil, time.Time{}},
+		// expired
+		{&Response{OCSPResponse: &ocsp.Response{ThisUpdate: now.Add(-48 * time.Hour), NextUpdate: now.Add(-time.Hour)}}, time.Time{}},
+		// due within the window, at 1m, then spread until it expires
+		{&Response{OCSPResponse: &ocsp.Response{ThisUpdate: now.Add(-24 * time.Hour), NextUpdate: now.Add(30 * time.Minute)}}, now.Add(time.Minute + 29*time.Minute/2)},
+		// due after the window, 48h before it expires
+		{&Response{OCSPResponse: &ocsp.Response{ThisUpdate: now.Add(-24 * time.Hour), NextUpdate: now.Add(72 * time.Hour)}}, now.Add(24 * time.Hour)},
+		{&Response{OCSPResponse: &ocsp.Response{ThisUpdate: now, NextUpdate: now.Add(72 * time.Hour)}, MaxAge: now.Add(2 * time.Hour)}, now.Add(2 * time.Hour)},
+	} {
+		tag := strconv.Itoa(i)
+		if err := u.AddOrUpdate(tag, &Request{
+			endpoints: []endpoint{{url: "http://respo.nd/er/" + tag}},
+			notAfter:  now.Add(24 * time.Hour),
+		}, tt.resp); err != nil {
+			t.Fatal(err)
+		}
+		if s := u.tagToStatus[tag]; !s.NextUpdate.Equal(tt.expected) {
+			t.Errorf("updater.AddOrUpdate #%d: next update at %v, want %v", i, s.NextUpdate, tt.expected)
+		}
+	}
+}
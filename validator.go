@@ -0,0 +1,90 @@
+package ocspd
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+var (
+	errSignerExpired        = errors.New("ocspd: OCSP response signer certificate is expired")
+	errSignerNotYetValid    = errors.New("ocspd: OCSP response signer certificate is not yet valid")
+	errSignerNoCheckMissing = errors.New("ocspd: OCSP response signer certificate has no id-pkix-ocsp-nocheck extension")
+	errSignerExpiresEarly   = errors.New("ocspd: OCSP response signer certificate expires before the response's next update")
+)
+
+// id-pkix-ocsp-nocheck, see RFC 6960 section 4.2.2.2.1
+var idPKIXOCSPNoCheck = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 5}
+
+// A ResponseValidator validates an OCSP response once it has been parsed and
+// its signature checked against the issuer; issuer can be nil.
+//
+// Returning an error causes the response to be rejected.
+type ResponseValidator func(resp *ocsp.Response, issuer *x509.Certificate, now time.Time) error
+
+// SignerPolicy is a validation policy for responses signed by a delegated
+// OCSP signer (rather than directly by the issuer.)
+//
+// Responses whose delegated signer is expired or not yet valid are always
+// rejected.
+type SignerPolicy struct {
+	// RequireNoCheck rejects responses whose signer certificate does not
+	// carry the id-pkix-ocsp-nocheck extension.
+	RequireNoCheck bool
+	// RequireValidUntilNextUpdate rejects responses whose signer certificate
+	// expires before the response's NextUpdate.
+	RequireValidUntilNextUpdate bool
+}
+
+// Validate implements the policy; it can be used as a ResponseValidator.
+func (p SignerPolicy) Validate(resp *ocsp.Response, issuer *x509.Certificate, now time.Time) error {
+	signer := resp.Certificate
+	if signer == nil {
+		// signed directly by the issuer
+		return nil
+	}
+	if now.Before(signer.NotBefore) {
+		return errSignerNotYetValid
+	}
+	if now.After(signer.NotAfter) {
+		return errSignerExpired
+	}
+	if p.RequireNoCheck && !hasExtension(signer, idPKIXOCSPNoCheck) {
+		return errSignerNoCheckMissing
+	}
+	if p.RequireValidUntilNextUpdate && !resp.NextUpdate.IsZero() && signer.NotAfter.Before(resp.NextUpdate) {
+		return errSignerExpiresEarly
+	}
+	return nil
+}
+
+// DefaultResponseValidator is the ResponseValidator used by a Fetcher without
+// ResponseValidator: it rejects responses whose delegated signer is expired or
+// not yet valid.
+var DefaultResponseValidator ResponseValidator = SignerPolicy{}.Validate
+
+func hasExtension(cert *x509.Certificate, id asn1.ObjectIdentifier) bool {
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// responseExpiry returns the time after which the response can no longer be
+// used: its NextUpdate, or its delegated signer's NotAfter if earlier.
+//
+// It returns the zero time if the response has no NextUpdate.
+func responseExpiry(resp *ocsp.Response) time.Time {
+	if resp.NextUpdate.IsZero() {
+		return time.Time{}
+	}
+	if resp.Certificate != nil && resp.Certificate.NotAfter.Before(resp.NextUpdate) {
+		return resp.Certificate.NotAfter
+	}
+	return resp.NextUpdate
+}
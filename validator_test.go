@@ -0,0 +1,139 @@
+package ocspd
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestSignerPolicy(t *testing.T) {
+	now := time.Date(2016, 1, 10, 22, 44, 0, 0, time.UTC)
+	noCheck := []pkix.Extension{{Id: idPKIXOCSPNoCheck, Value: []byte{0x05, 0x00}}}
+
+	tests := []struct {
+		name        string
+		policy      SignerPolicy
+		response    ocsp.Response
+		expectedErr error
+	}{
+		{
+			name: "signed by issuer",
+			response: ocsp.Response{
+				NextUpdate: now.Add(24 * time.Hour),
+			},
+		},
+		{
+			name: "valid signer",
+			response: ocsp.Response{
+				NextUpdate: now.Add(24 * time.Hour),
+				Certificate: &x509.Certificate{
+					NotBefore: now.Add(-24 * time.Hour),
+					NotAfter:  now.Add(1 * time.Hour),
+				},
+			},
+		},
+		{
+			name: "expired signer",
+			response: ocsp.Response{
+				NextUpdate: now.Add(24 * time.Hour),
+				Certificate: &x509.Certificate{
+					NotBefore: now.Add(-24 * time.Hour),
+					NotAfter:  now.Add(-1 * time.Hour),
+				},
+			},
+			expectedErr: errSignerExpired,
+		},
+		{
+			name: "not yet valid signer",
+			response: ocsp.Response{
+				NextUpdate: now.Add(24 * time.Hour),
+				Certificate: &x509.Certificate{
+					NotBefore: now.Add(1 * time.Hour),
+					NotAfter:  now.Add(48 * time.Hour),
+				},
+			},
+			expectedErr: errSignerNotYetValid,
+		},
+		{
+			name:   "missing id-pkix-ocsp-nocheck",
+			policy: SignerPolicy{RequireNoCheck: true},
+			response: ocsp.Response{
+				NextUpdate: now.Add(24 * time.Hour),
+				Certificate: &x509.Certificate{
+					NotBefore: now.Add(-24 * time.Hour),
+					NotAfter:  now.Add(48 * time.Hour),
+				},
+			},
+			expectedErr: errSignerNoCheckMissing,
+		},
+		{
+			name:   "with id-pkix-ocsp-nocheck",
+			policy: SignerPolicy{RequireNoCheck: true},
+			response: ocsp.Response{
+				NextUpdate: now.Add(24 * time.Hour),
+				Certificate: &x509.Certificate{
+					NotBefore:  now.Add(-24 * time.Hour),
+					NotAfter:   now.Add(48 * time.Hour),
+					Extensions: noCheck,
+				},
+			},
+		},
+		{
+			name:   "signer expires before NextUpdate",
+			policy: SignerPolicy{RequireValidUntilNextUpdate: true},
+			response: ocsp.Response{
+				NextUpdate: now.Add(24 * time.Hour),
+				Certificate: &x509.Certificate{
+					NotBefore: now.Add(-24 * time.Hour),
+					NotAfter:  now.Add(1 * time.Hour),
+				},
+			},
+			expectedErr: errSignerExpiresEarly,
+		},
+	}
+	for _, test := range tests {
+		if err := test.policy.Validate(&test.response, nil, now); err != test.expectedErr {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.expectedErr)
+		}
+	}
+}
+
+func TestResponseExpiry(t *testing.T) {
+	now := time.Date(2016, 1, 10, 22, 44, 0, 0, time.UTC)
+	tests := []struct {
+		response ocsp.Response
+		expected time.Time
+	}{
+		{
+			response: ocsp.Response{},
+		},
+		{
+			response: ocsp.Response{
+				NextUpdate: now,
+			},
+			expected: now,
+		},
+		{
+			response: ocsp.Response{
+				NextUpdate:  now,
+				Certificate: &x509.Certificate{NotAfter: now.Add(1 * time.Hour)},
+			},
+			expected: now,
+		},
+		{
+			response: ocsp.Response{
+				NextUpdate:  now,
+				Certificate: &x509.Certificate{NotAfter: now.Add(-1 * time.Hour)},
+			},
+			expected: now.Add(-1 * time.Hour),
+		},
+	}
+	for i, test := range tests {
+		if e := responseExpiry(&test.response); !e.Equal(test.expected) {
+			t.Errorf("responseExpiry #%d: got %v, want %v", i, e, test.expected)
+		}
+	}
+}